@@ -0,0 +1,279 @@
+package main
+
+import (
+	"archive/tar"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Folders with lots of small files (like .git) are stored as a single archive
+const ARCHIVE_TAR_GZIP = "tar+gzip"
+const ARCHIVE_TAR_ZSTD = "tar+zstd"
+
+var FlagPackDir []string
+var FlagNoPackDir []string
+var FlagPackDirsFrom []string
+var FlagPackDirFormat string
+
+// Rules for which folders are packed and the format used for new archives
+var PackDirRules []PathRule
+var PackDirFormat string = ARCHIVE_TAR_GZIP
+
+// A file inside a packed folder (Path is relative to the folder)
+type ArchiveMember struct {
+	Path       string    `json:path`
+	Type       string    `json:type`
+	TargetPath string    `json:target_path`
+	Size       int64     `json:size`
+	User       string    `json:user`
+	Group      string    `json:group`
+	Mode       uint32    `json:mode`
+	ModTime    time.Time `json:mod_time`
+}
+
+func ParseArchiveFormat(name string) (string, error) {
+	switch strings.ToLower(name) {
+	case ARCHIVE_TAR_GZIP, "tar.gz", "tgz":
+		return ARCHIVE_TAR_GZIP, nil
+	case ARCHIVE_TAR_ZSTD, "tar.zst":
+		return ARCHIVE_TAR_ZSTD, nil
+	}
+	return "", errors.New("unknown archive format: " + name)
+}
+
+// Codec that compresses the tar stream of an archive format
+func archive_codec(format string) (string, error) {
+	switch format {
+	case ARCHIVE_TAR_GZIP:
+		return CODEC_GZIP, nil
+	case ARCHIVE_TAR_ZSTD:
+		return CODEC_ZSTD, nil
+	}
+	return "", errors.New("unknown archive format: " + format)
+}
+
+// Builds the rules that decide which folders are packed: the defaults (SpecialFoldersToPack), then files, then --pack-dir and --no-pack-dir
+func LoadPackDirRules(root string) ([]PathRule, error) {
+	rules := make([]PathRule, 0)
+	add := func(pattern, source string) error {
+		rule, err := NewPathRule(pattern, root, source)
+		if rule != nil {
+			rules = append(rules, *rule)
+		}
+		return err
+	}
+	for _, name := range SpecialFoldersToPack {
+		add(name+"/", "defaults")
+	}
+	for _, path := range FlagPackDirsFrom {
+		file_rules, err := LoadRuleFile(path, root)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, file_rules...)
+	}
+	for _, pattern := range FlagPackDir {
+		if err := add(pattern, "--pack-dir"); err != nil {
+			return nil, err
+		}
+	}
+	for _, pattern := range FlagNoPackDir {
+		if err := add("!"+strings.TrimPrefix(pattern, "!"), "--no-pack-dir"); err != nil {
+			return nil, err
+		}
+	}
+	return rules, nil
+}
+
+func should_pack_dir(path string) bool {
+	return MatchRules(PackDirRules, path, true) != nil
+}
+
+// Writes the folder (and everything in it) as an archive whose entries start with the folder name
+func write_archive(out io.Writer, format, dir string) ([]ArchiveMember, error) {
+	codec, err := archive_codec(format)
+	if err != nil {
+		return nil, err
+	}
+	compressor, err := codec_writer(codec, out)
+	if err != nil {
+		return nil, err
+	}
+	tw := tar.NewWriter(compressor)
+	members := make([]ArchiveMember, 0)
+	parent := filepath.Dir(dir)
+	err = filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		target := ""
+		if info.Mode()&os.ModeSymlink != 0 {
+			target, err = os.Readlink(path)
+			if err != nil {
+				return err
+			}
+		} else if !info.Mode().IsRegular() && !info.IsDir() {
+			Log.WarningF("Skipping '%s' on archive (invalid inode type, ex: sockets)", path)
+			return nil
+		}
+		hdr, err := tar.FileInfoHeader(info, target)
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(parent, path)
+		hdr.Name = filepath.ToSlash(rel)
+		if info.IsDir() {
+			hdr.Name += "/"
+		}
+		// Only what matters, so the same folder always makes the same archive
+		hdr.AccessTime = time.Time{}
+		hdr.ChangeTime = time.Time{}
+		err = tw.WriteHeader(hdr)
+		if err != nil {
+			return err
+		}
+		if info.Mode().IsRegular() {
+			fptr, err := os.Open(path)
+			if err != nil {
+				return err
+			}
+			_, err = io.Copy(tw, fptr)
+			fptr.Close()
+			if err != nil {
+				return err
+			}
+		}
+		if path != dir {
+			members = append(members, archive_member(path, dir, info, hdr))
+		}
+		return nil
+	})
+	if err == nil {
+		err = tw.Close()
+	}
+	if err == nil {
+		err = compressor.Close()
+	}
+	return members, err
+}
+
+func archive_member(path, dir string, info os.FileInfo, hdr *tar.Header) ArchiveMember {
+	member := ArchiveMember{}
+	member.Path, _ = filepath.Rel(dir, path)
+	member.Type = INODE_TYPE_FILE
+	if info.IsDir() {
+		member.Type = INODE_TYPE_DIRECTORY
+	} else if info.Mode()&os.ModeSymlink != 0 {
+		member.Type = INODE_TYPE_SYMBOLIC_LINK
+	}
+	member.TargetPath = hdr.Linkname
+	if info.Mode().IsRegular() {
+		member.Size = info.Size()
+	}
+	member.User = hdr.Uname
+	member.Group = hdr.Gname
+	member.Mode = FileModeToStatMode(info.Mode())
+	member.ModTime = info.ModTime()
+	return member
+}
+
+// Extracts an archive inside dest_dir (which must exist)
+func extract_archive(in io.Reader, format, dest_dir string) error {
+	codec, err := archive_codec(format)
+	if err != nil {
+		return err
+	}
+	decompressor, err := codec_reader(codec, in)
+	if err != nil {
+		return err
+	}
+	defer decompressor.Close()
+	tr := tar.NewReader(decompressor)
+	dirs := make([]*tar.Header, 0)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		dest := filepath.Join(dest_dir, filepath.FromSlash(hdr.Name))
+		if !strings.HasPrefix(dest, filepath.Clean(dest_dir)+string(filepath.Separator)) {
+			return fmt.Errorf("archive entry '%s' is outside of the archive folder", hdr.Name)
+		}
+		mode := archive_entry_mode(hdr)
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			err = os.MkdirAll(dest, 0700)
+			hdr.Name = dest
+			dirs = append(dirs, hdr)
+		case tar.TypeReg, tar.TypeRegA:
+			err = extract_archive_file(tr, dest, mode)
+			if err == nil {
+				// The umask does not apply to chmod (and setuid, setgid and sticky need it)
+				err = os.Chmod(dest, mode)
+			}
+			if err == nil {
+				err = os.Chtimes(dest, hdr.ModTime, hdr.ModTime)
+			}
+		case tar.TypeSymlink:
+			err = os.Symlink(hdr.Linkname, dest)
+		default:
+			Log.WarningF("Skipping archive entry '%s' (unsupported type %c)", hdr.Name, hdr.Typeflag)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	// Folder permissions and times last, otherwise creating their content would change them
+	for i := len(dirs) - 1; i >= 0; i-- {
+		os.Chmod(dirs[i].Name, archive_entry_mode(dirs[i]))
+		os.Chtimes(dirs[i].Name, dirs[i].ModTime, dirs[i].ModTime)
+	}
+	return nil
+}
+
+// Permissions with setuid, setgid and sticky bits
+func archive_entry_mode(hdr *tar.Header) os.FileMode {
+	return StatModeToFileMode(uint32(hdr.Mode)) & (os.ModePerm | os.ModeSetuid | os.ModeSetgid | os.ModeSticky)
+}
+
+func extract_archive_file(in io.Reader, dest string, mode os.FileMode) error {
+	err := os.MkdirAll(filepath.Dir(dest), 0700)
+	if err != nil {
+		return err
+	}
+	fptr, err := os.OpenFile(dest, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(fptr, in)
+	if err != nil {
+		fptr.Close()
+		return err
+	}
+	return fptr.Close()
+}
+
+// Run it inside a transaction (like *SaveBatch), so the members are saved all at once
+func SaveArchiveMembers(q Querier, hash string, members []ArchiveMember) error {
+	var n int
+	err := q.QueryRow("SELECT COUNT(*) FROM `archive_members` WHERE `hash` = ?;", hash).Scan(&n)
+	if err != nil || n > 0 {
+		return err
+	}
+	for _, member := range members {
+		_, err = q.Exec("INSERT OR IGNORE INTO `archive_members` (`hash`, `path`, `type`, `target_path`, `size`, `user`, `group`, `mode`, `mod_time`) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?);", hash, member.Path, member.Type, member.TargetPath, member.Size, member.User, member.Group, member.Mode, member.ModTime.Unix())
+		if err != nil {
+			Log.Warning(err)
+			return err
+		}
+	}
+	return nil
+}
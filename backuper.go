@@ -1,22 +1,27 @@
 package main
 
 import (
-	"encoding/hex"
-	"io"
+	"fmt"
 	"io/ioutil"
 	"os"
 	"sync"
-
-	"golang.org/x/crypto/sha3"
+	"time"
 )
 
 var INodesToSaveCh chan INode
 var PathsToScanCh chan string
 var FinishedSavingCh chan bool
-var IgnoreFolders []string = []string{".git", ".cvs", ".svn", ".cache"}
+
+// Folders whose content is never scanned (packed folders are handled by PackDirRules, so --no-pack-dir can bring them back)
+var IgnoreFolders []string = []string{".cvs", ".cache"}
 var SpecialFoldersToPack []string = []string{".git", ".svn", ".hg"}
 var MarkedForDeletion []string
 var MarkedForDeletionLock *sync.Mutex
+var FlagRehashAll bool
+var HashedFilesCount int64
+var ReusedHashesCount int64
+var HashWorkers int
+var ScannerWG *sync.WaitGroup
 
 func ContainsStr(haystack []string, needle string) bool {
 	for _, hay := range haystack {
@@ -28,46 +33,133 @@ func ContainsStr(haystack []string, needle string) bool {
 }
 
 func inode_saver_consumer() {
+	batch := SaverBatch
+	// Commits old batches even if no inodes come for a while
+	ticker := time.NewTicker(FlagBatchTime/4 + time.Millisecond)
+	defer ticker.Stop()
+	inodes := INodesToSaveCh
 	for {
-		inode, more := <-INodesToSaveCh
-		if !more {
-			Log.Notice("Finished saving inodes to database")
-			close(CopierCh)
+		select {
+		case inode, more := <-inodes:
+			if !more {
+				inode_saver_commit(batch, true)
+				Log.Notice("Finished saving inodes to database")
+				close(CopierCh)
+				// Keep saving the locations of the blobs the copiers confirm
+				inodes = nil
+				continue
+			}
+			inode_saver_save(batch, inode)
+			inode_saver_commit(batch, false)
+		case <-CopierDoneCh:
+			// The last locations and the snapshot are committed together by the caller
 			FinishedSavingCh <- true
 			return
+		case <-ticker.C:
+			inode_saver_commit(batch, false)
 		}
-		err := inode.Save()
-		if err != nil {
-			Log.Warning(err)
-			continue
-		}
-		// Check for blob
-		if inode.Hash == "" {
-			continue
-		}
-		blob, err := LoadBlob(inode.Hash)
+	}
+}
+
+func inode_saver_commit(batch *SaveBatch, force bool) {
+	var err error
+	if force {
+		err = batch.Commit()
+	} else {
+		err = batch.MaybeCommit()
+	}
+	if err != nil {
+		Log.Warning("Failed to commit inodes to database: " + err.Error())
+		BackupSnapshot.AddError()
+	}
+}
+
+func inode_saver_save(batch *SaveBatch, inode INode) {
+	err := inode.Save(batch)
+	if err != nil {
+		Log.Warning(err)
+		BackupSnapshot.AddError()
+		unstage(inode.HackPath, inode.HackData)
+		return
+	}
+	BackupSnapshot.AddINode(inode.Size)
+	// Check for blob
+	if inode.Hash == "" {
+		return
+	}
+	if len(inode.Members) > 0 && SaveArchiveMembers(batch, inode.Hash, inode.Members) != nil {
+		BackupSnapshot.AddError()
+	}
+	// Big files may be split in many blobs (the database knows best, as the file might have been stored whole before)
+	chunks, err := LoadBlobChunks(batch, inode.Hash)
+	if err != nil {
+		BackupSnapshot.AddError()
+		return
+	}
+	if len(chunks) == 0 && len(inode.Chunks) > 0 {
+		blob, err := LoadBlob(batch, inode.Hash)
 		if err != nil {
 			Log.Warning(err)
 		}
-		if blob.Hash != "" {
-			Log.DebugF("Found blob for '%s' on volume %s", inode.OriginalPath, blob.VolUUID)
-		} else {
+		if blob.Hash == "" {
 			blob.Hash = inode.Hash
 			blob.Size = inode.Size
-			blob.VolUUID = BackupVolUUID
-			Log.DebugF("Blob for '%s' has not been copied yet", inode.HackPath)
-			err = blob.Save()
-			if err != nil {
-				Log.Warning(err)
-				continue
+			if blob.Save(batch) != nil || SaveBlobChunks(batch, inode.Hash, inode.Chunks) != nil {
+				BackupSnapshot.AddError()
+				return
 			}
-			AddToCopier(inode.HackPath, inode.Hash, blob.Size)
+			chunks = inode.Chunks
+		}
+	}
+	if len(chunks) == 0 {
+		if !inode_saver_blob(batch, inode.HackPath, inode.HackData, inode.Hash, inode.Size, 0) {
+			unstage(inode.HackPath, inode.HackData)
 		}
+		return
 	}
+	for _, chunk := range chunks {
+		inode_saver_blob(batch, inode.HackPath, nil, chunk.Hash, chunk.Size, chunk.Offset)
+	}
+}
+
+// Ensures the blob is in the database and, if it is not on the volume yet, asks the copier to copy it (returns whether it did)
+func inode_saver_blob(batch *SaveBatch, path string, data []byte, hash string, size, offset int64) bool {
+	blob, err := LoadBlob(batch, hash)
+	if err != nil {
+		Log.Warning(err)
+	}
+	if blob.Hash == "" {
+		blob.Hash = hash
+		blob.Size = size
+		err = blob.Save(batch)
+		if err != nil {
+			Log.Warning(err)
+			BackupSnapshot.AddError()
+			return false
+		}
+	}
+	// The blob may already be on other volumes, but what matters is the one we are backing up to
+	loc, err := LoadBlobLocation(batch, hash, BackupVolUUID)
+	if err != nil {
+		Log.Warning(err)
+	}
+	if loc.Hash != "" {
+		Log.DebugF("Found blob for '%s' on volume %s", path, loc.VolUUID)
+		return false
+	}
+	// Its location is saved once the copier has written and checked it
+	if batch.IsCopying(hash) {
+		Log.DebugF("Blob for '%s' is already being copied to volume %s", path, BackupVolUUID)
+		return false
+	}
+	Log.DebugF("Blob for '%s' has not been copied to volume %s yet", path, BackupVolUUID)
+	BackupSnapshot.AddBlob()
+	batch.AddToCopier(path, data, hash, size, offset)
+	return true
 }
 
 // Recursivelly lists the filesystem in order to list what inodes will be scanned. DO NOT run more than one goroutine for this
-func inode_scanner_producer(root string, is_root bool) {
+func inode_scanner_producer(root string, is_root bool, bluignore []PathRule) {
 	if is_root {
 		Log.NoticeF("Started looking for files to backup on '%s'", root)
 	}
@@ -75,33 +167,65 @@ func inode_scanner_producer(root string, is_root bool) {
 	if err != nil {
 		Log.Warning(err)
 	}
+	bluignore = load_bluignore(root, bluignore)
 	for _, child := range children {
 		full_path_child := root + "/" + child.Name()
-		PathsToScanCh <- full_path_child
+		if full_path_child == StagingDir {
+			continue
+		}
+		if rule := MatchBackupRules(bluignore, full_path_child, child.IsDir()); rule != nil {
+			if FlagDryRun {
+				fmt.Printf("excluded %s (rule %s)\n", full_path_child, rule)
+			} else {
+				Log.DebugF("Excluded '%s' (rule %s)", full_path_child, rule)
+			}
+			continue
+		}
+		if !FlagDryRun {
+			PathsToScanCh <- full_path_child
+		}
 		if child.IsDir() {
-			if !ContainsStr(IgnoreFolders, child.Name()) && !ContainsStr(SpecialFoldersToPack, child.Name()) {
-				inode_scanner_producer(full_path_child, false)
+			if !ContainsStr(IgnoreFolders, child.Name()) && !should_pack_dir(full_path_child) {
+				inode_scanner_producer(full_path_child, false, bluignore)
 			}
 		}
 	}
 
-	if is_root {
+	if is_root && !FlagDryRun {
 		Log.Info("Finished paths to scan")
 		close(PathsToScanCh)
 	}
 }
 
+// Starts the workers that hash files. The last one to finish closes INodesToSaveCh.
+func start_inode_scanners(n int) {
+	if n < 1 {
+		n = 1
+	}
+	Log.InfoF("Starting %d hash workers", n)
+	ScannerWG = &sync.WaitGroup{}
+	ScannerWG.Add(n)
+	for i := 0; i < n; i++ {
+		go inode_scanner_consumer()
+	}
+	go func() {
+		ScannerWG.Wait()
+		Log.Info("Closing INodesToSaveCh...")
+		close(INodesToSaveCh)
+	}()
+}
+
 func inode_scanner_consumer() {
+	defer ScannerWG.Done()
 	for {
 		path, more := <-PathsToScanCh
 		if !more {
-			Log.Info("Closing INodesToSaveCh...")
-			close(INodesToSaveCh)
 			return
 		}
 		node, err := NewINodeFromFile(path)
 		if err != nil {
 			Log.Warning(node.OriginalPath, err)
+			BackupSnapshot.AddError()
 		}
 	}
 }
@@ -118,6 +242,9 @@ func delete_marked() {
 	defer MarkedForDeletionLock.Unlock()
 	for _, path := range MarkedForDeletion {
 		err = os.Remove(path)
+		if os.IsNotExist(err) {
+			continue
+		}
 		if err != nil {
 			Log.Warning("Failed to delete '" + path + "': " + err.Error())
 		} else {
@@ -135,12 +262,9 @@ func hash_file(path string) (string, int64, error) {
 		return "", 0, err
 	}
 
-	hasher := sha3.New512()
-	size_hashed := int64(0)
-	if size_hashed, err = io.Copy(hasher, fptr); err != nil {
+	hash, size_hashed, err := hash_reader(fptr)
+	if err != nil {
 		Log.WarningF("Failed to hash file '%s': %s ", path, err)
-		return "", 0, err
 	}
-	hash := "SHA3-512:" + hex.EncodeToString(hasher.Sum(nil))
-	return hash, size_hashed, nil
+	return hash, size_hashed, err
 }
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"testing"
+)
+
+// Writes n files of random content spread over a few folders
+func make_scan_tree(tb testing.TB, n, size int) string {
+	root := tb.TempDir()
+	data := make([]byte, size)
+	for i := 0; i < n; i++ {
+		dir := filepath.Join(root, fmt.Sprintf("d%d", i%8))
+		err := os.MkdirAll(dir, 0755)
+		if err != nil {
+			tb.Fatal(err)
+		}
+		rand.Read(data)
+		err = ioutil.WriteFile(filepath.Join(dir, fmt.Sprintf("f%d", i)), data, 0644)
+		if err != nil {
+			tb.Fatal(err)
+		}
+	}
+	return root
+}
+
+// Runs the producer and the hash workers over root (without a saver) and returns the hash of every path
+func scan_tree(root string, workers int) map[string]string {
+	old_rehash, old_snapshot := FlagRehashAll, BackupSnapshot
+	defer func() { FlagRehashAll, BackupSnapshot = old_rehash, old_snapshot }()
+	FlagRehashAll = true
+	BackupSnapshot = NewSnapshot(root, "")
+	PathsToScanCh = make(chan string, 128)
+	INodesToSaveCh = make(chan INode, 2048)
+	go inode_scanner_producer(root, true, nil)
+	start_inode_scanners(workers)
+	hashes := make(map[string]string)
+	for node := range INodesToSaveCh {
+		hashes[node.OriginalPath] = node.Hash
+	}
+	return hashes
+}
+
+func TestHashWorkersSameHashes(t *testing.T) {
+	root := make_scan_tree(t, 40, 4096)
+	one := scan_tree(root, 1)
+	many := scan_tree(root, 4)
+	if len(one) != 48 {
+		t.Fatalf("scanned %d paths, expected 40 files and 8 folders", len(one))
+	}
+	paths := make([]string, 0, len(one))
+	for path := range one {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	for _, path := range paths {
+		if many[path] != one[path] {
+			t.Errorf("%s: hashed as %q by 1 worker and %q by 4 workers", path, one[path], many[path])
+		}
+	}
+}
+
+// Compares the old design (a single scanner) with many hash workers (the speedup needs as many CPUs)
+func BenchmarkHashWorkers(b *testing.B) {
+	const n_files, file_size = 64, 1 << 20
+	root := make_scan_tree(b, n_files, file_size)
+	counts := []int{1, 4}
+	if runtime.NumCPU() > 4 {
+		counts = append(counts, runtime.NumCPU())
+	}
+	for _, workers := range counts {
+		b.Run(fmt.Sprintf("workers=%d", workers), func(b *testing.B) {
+			b.SetBytes(n_files * file_size)
+			for i := 0; i < b.N; i++ {
+				scan_tree(root, workers)
+			}
+		})
+	}
+}
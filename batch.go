@@ -0,0 +1,267 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Anything that looks like *sql.DB, *sql.Tx or *SaveBatch
+type Querier interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+var FlagSynchronous string
+var FlagBatchRows int
+var FlagBatchTime time.Duration
+
+// The batch of the running backup (aborting it must roll it back before marking the snapshot as aborted)
+var SaverBatch *SaveBatch
+
+// Values of PRAGMA synchronous
+func ParseSynchronous(str string) (string, error) {
+	str = strings.ToUpper(str)
+	switch str {
+	case "OFF", "NORMAL", "FULL", "EXTRA":
+		return str, nil
+	}
+	return "", errors.New("invalid synchronous level (use off, normal, full or extra): " + str)
+}
+
+// Groups the writes of the inode saver in transactions (SQLite syncs once per commit, not once per row). Statements are prepared once per transaction.
+type SaveBatch struct {
+	MaxRows int
+	MaxAge  time.Duration
+	lock    sync.Mutex // Guards closed, tx and stmts, as Rollback may be called by another goroutine
+	closed  bool
+	tx      *sql.Tx
+	stmts   map[string]*sql.Stmt
+	rows    int
+	started time.Time
+	failed  bool // Some commit failed, so rows were lost
+	// Blobs are only handed to the copiers once their inodes are committed
+	orders []CopyOrder
+	// The copiers never write to the database (it would wait for our transaction), they tell us which blobs were written and checked instead. Their locations are saved on the next commit.
+	copied_lock sync.Mutex
+	copied      []BlobLocation
+	copying     map[string]bool // Blobs asked for and not saved yet, so they are copied only once
+}
+
+func NewSaveBatch(max_rows int, max_age time.Duration) *SaveBatch {
+	if max_rows < 1 {
+		max_rows = 1
+	}
+	return &SaveBatch{MaxRows: max_rows, MaxAge: max_age, copying: make(map[string]bool)}
+}
+
+// The transaction starts with the first statement (the lock must be held)
+func (batch *SaveBatch) begin() error {
+	if batch.closed {
+		return errors.New("the batch was rolled back")
+	}
+	if batch.tx != nil {
+		return nil
+	}
+	tx, err := DB.Begin()
+	if err != nil {
+		return err
+	}
+	batch.tx = tx
+	batch.stmts = make(map[string]*sql.Stmt)
+	batch.rows = 0
+	batch.started = time.Now()
+	return nil
+}
+
+func (batch *SaveBatch) stmt(query string) (*sql.Stmt, error) {
+	batch.lock.Lock()
+	defer batch.lock.Unlock()
+	err := batch.begin()
+	if err != nil {
+		return nil, err
+	}
+	stmt, ok := batch.stmts[query]
+	if ok {
+		return stmt, nil
+	}
+	stmt, err = batch.tx.Prepare(query)
+	if err != nil {
+		return nil, err
+	}
+	batch.stmts[query] = stmt
+	return stmt, nil
+}
+
+func (batch *SaveBatch) Exec(query string, args ...interface{}) (sql.Result, error) {
+	stmt, err := batch.stmt(query)
+	if err != nil {
+		return nil, err
+	}
+	batch.rows++
+	return stmt.Exec(args...)
+}
+
+func (batch *SaveBatch) Query(query string, args ...interface{}) (*sql.Rows, error) {
+	stmt, err := batch.stmt(query)
+	if err != nil {
+		return nil, err
+	}
+	return stmt.Query(args...)
+}
+
+// Like *sql.Tx, errors show up on Scan
+func (batch *SaveBatch) QueryRow(query string, args ...interface{}) *sql.Row {
+	stmt, err := batch.stmt(query)
+	if err != nil {
+		batch.lock.Lock()
+		tx := batch.tx
+		batch.lock.Unlock()
+		if tx == nil {
+			return DB.QueryRow(query, args...)
+		}
+		return tx.QueryRow(query, args...)
+	}
+	return stmt.QueryRow(args...)
+}
+
+// Whether some commit failed (the snapshot is then not complete)
+func (batch *SaveBatch) Failed() bool {
+	return batch.failed
+}
+
+// Queues a blob for the copiers (it is sent when the batch is committed)
+func (batch *SaveBatch) AddToCopier(origin string, data []byte, hash string, size, offset int64) {
+	order := NewCopyOrder(origin, hash, size, offset)
+	order.Data = data
+	batch.orders = append(batch.orders, order)
+	batch.copied_lock.Lock()
+	batch.copying[hash] = true
+	batch.copied_lock.Unlock()
+}
+
+// Whether the blob was asked for, but its location is not saved yet
+func (batch *SaveBatch) IsCopying(hash string) bool {
+	batch.copied_lock.Lock()
+	defer batch.copied_lock.Unlock()
+	return batch.copying[hash]
+}
+
+// Called by the copiers once the blob is written and checked
+func (batch *SaveBatch) Copied(loc BlobLocation) {
+	batch.copied_lock.Lock()
+	batch.copied = append(batch.copied, loc)
+	batch.copied_lock.Unlock()
+}
+
+// Called by the copiers if the blob could not be written (so the next inode with it may try again)
+func (batch *SaveBatch) CopyFailed(hash string) {
+	batch.copied_lock.Lock()
+	delete(batch.copying, hash)
+	batch.copied_lock.Unlock()
+}
+
+// A location that fails to be saved only loses itself (the blob is copied again by the next backup), not the inodes of the batch
+func (batch *SaveBatch) save_copied() {
+	batch.copied_lock.Lock()
+	copied := batch.copied
+	batch.copied = nil
+	batch.copied_lock.Unlock()
+	for _, loc := range copied {
+		err := batch.save_location(loc)
+		if err != nil {
+			Log.WarningF("Failed to save location of blob '%s' on volume %s: %s", loc.Hash, loc.VolUUID, err)
+			BackupSnapshot.AddError()
+		}
+		batch.copied_lock.Lock()
+		delete(batch.copying, loc.Hash)
+		batch.copied_lock.Unlock()
+	}
+}
+
+func (batch *SaveBatch) save_location(loc BlobLocation) error {
+	savepoint, err := batch.stmt("SAVEPOINT `location`;")
+	if err != nil {
+		return err
+	}
+	_, err = savepoint.Exec()
+	if err != nil {
+		return err
+	}
+	err = loc.Save(batch)
+	if err != nil {
+		if rollback, err := batch.stmt("ROLLBACK TO `location`;"); err == nil {
+			rollback.Exec()
+		}
+	}
+	if release, err := batch.stmt("RELEASE `location`;"); err == nil {
+		release.Exec()
+	}
+	return err
+}
+
+// Commits if the batch is big or old enough
+func (batch *SaveBatch) MaybeCommit() error {
+	batch.save_copied()
+	batch.lock.Lock()
+	idle := batch.tx == nil
+	batch.lock.Unlock()
+	if idle && len(batch.orders) == 0 {
+		return nil
+	}
+	if batch.rows < batch.MaxRows && time.Since(batch.started) < batch.MaxAge {
+		return nil
+	}
+	return batch.Commit()
+}
+
+// Commits and then sends the queued blobs to the copiers. If the commit fails, the blobs are forgotten (their inodes were never saved).
+func (batch *SaveBatch) Commit() error {
+	batch.save_copied()
+	var err error
+	batch.lock.Lock()
+	if batch.closed {
+		err = errors.New("the batch was rolled back")
+	} else if batch.tx != nil {
+		for _, stmt := range batch.stmts {
+			stmt.Close()
+		}
+		err = batch.tx.Commit()
+		if err == nil {
+			Log.DebugF("Committed %d rows to the database", batch.rows)
+		}
+		batch.tx = nil
+		batch.stmts = nil
+		batch.rows = 0
+	}
+	batch.lock.Unlock()
+	if err != nil {
+		batch.failed = true
+	}
+	orders := batch.orders
+	batch.orders = nil
+	for _, order := range orders {
+		if err != nil {
+			unstage(order.Origin, order.Data)
+			batch.CopyFailed(order.Hash)
+			continue
+		}
+		CopierCh <- order
+	}
+	return err
+}
+
+// Drops whatever was not committed yet and refuses new statements
+func (batch *SaveBatch) Rollback() {
+	batch.lock.Lock()
+	defer batch.lock.Unlock()
+	batch.closed = true
+	if batch.tx != nil {
+		batch.tx.Rollback()
+		batch.tx = nil
+		batch.stmts = nil
+	}
+}
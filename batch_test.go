@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func open_test_batch(t *testing.T) *SaveBatch {
+	open_test_db(t)
+	if err := MigrateDB(); err != nil {
+		t.Fatal(err)
+	}
+	old := BackupSnapshot
+	BackupSnapshot = NewSnapshot("/src", "test-vol")
+	t.Cleanup(func() { BackupSnapshot = old })
+	return NewSaveBatch(1000, time.Hour)
+}
+
+func count_rows(t *testing.T, table string) int {
+	var n int
+	if err := DB.QueryRow("SELECT COUNT(*) FROM `" + table + "`;").Scan(&n); err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+// A location that cannot be saved must not take the rest of the batch with it
+func TestSaveBatchLocationFailure(t *testing.T) {
+	batch := open_test_batch(t)
+	blob := Blob{Hash: "SHA3-512:abc", Size: 3}
+	if err := blob.Save(batch); err != nil {
+		t.Fatal(err)
+	}
+	loc := NewBlobLocation(blob.Hash, "test-vol")
+	batch.Copied(loc)
+	batch.Copied(loc) // Same primary key
+	if err := batch.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if n := count_rows(t, "blobs"); n != 1 {
+		t.Errorf("saved %d blobs, expected 1", n)
+	}
+	if n := count_rows(t, "blob_locations"); n != 1 {
+		t.Errorf("saved %d blob locations, expected 1", n)
+	}
+	if batch.Failed() || BackupSnapshot.ErrorsCount != 1 {
+		t.Errorf("batch failed = %v with %d errors, expected a single error", batch.Failed(), BackupSnapshot.ErrorsCount)
+	}
+}
+
+// Aborting a backup rolls back the batch while the saver is still using it
+func TestSaveBatchRollback(t *testing.T) {
+	batch := open_test_batch(t)
+	done := make(chan int)
+	go func() {
+		i := 0
+		for ; ; i++ {
+			blob := Blob{Hash: fmt.Sprintf("SHA3-512:%d", i), Size: 1}
+			if blob.Save(batch) != nil {
+				break
+			}
+		}
+		done <- i
+	}()
+	time.Sleep(10 * time.Millisecond)
+	batch.Rollback()
+	<-done
+	if err := batch.Commit(); err == nil || !batch.Failed() {
+		t.Error("commit after rollback did not fail")
+	}
+	if n := count_rows(t, "blobs"); n != 0 {
+		t.Errorf("%d blobs were saved after the rollback", n)
+	}
+}
@@ -1,6 +1,12 @@
 package main
 
 import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
 	"strings"
 	"time"
 )
@@ -8,10 +14,21 @@ import (
 type Blob struct {
 	Hash       string    `json:hash`
 	Size       int64     `json:size`
-	VolUUID    string    `json:volume_uuid`
 	FirstAdded time.Time `json:first_added`
 }
 
+// Records that a copy of a blob exists on a volume. The same blob may be on many volumes.
+type BlobLocation struct {
+	Hash         string    `json:hash`
+	VolUUID      string    `json:volume_uuid`
+	Added        time.Time `json:added`
+	LastVerified time.Time `json:last_verified`
+	Codec        string    `json:codec`
+	StoredSize   int64     `json:stored_size` // Bytes actually used on the volume
+	Pack         string    `json:pack`        // Empty if the blob is stored on its own file
+	PackOffset   int64     `json:pack_offset`
+}
+
 func Hash2Path(src_hash string) string {
 	parts := strings.Split(src_hash, ":")
 	alg := parts[0]
@@ -19,9 +36,194 @@ func Hash2Path(src_hash string) string {
 	return alg + "/" + hash[0:3] + "/" + hash[3:6] + "/" + hash
 }
 
-func LoadBlob(hash string) (Blob, error) {
+// Path of the blob inside the volume folder
+func (vol Vol) BlobPath(hash string) string {
+	if vol.Encryption != "" {
+		return filepath.Join(vol.Dir, EncHash2Path(vol.Keys, hash))
+	}
+	return filepath.Join(vol.Dir, Hash2Path(hash))
+}
+
+// Size an uncompressed blob should have on the volume
+func (vol Vol) BlobStoredSize(size int64) int64 {
+	if vol.Encryption != "" {
+		return enc_stored_size(size)
+	}
+	return size
+}
+
+// Counts how many bytes are written
+type counting_writer struct {
+	out io.Writer
+	n   int64
+}
+
+func (w *counting_writer) Write(p []byte) (int, error) {
+	n, err := w.out.Write(p)
+	w.n += int64(n)
+	return n, err
+}
+
+// Copies a blob to the volume using the codec in loc and sets loc.StoredSize. The blob is written to a temporary file first, so a half written blob never looks like a real one. Small blobs go to a pack instead if the volume has a pack writer.
+func (vol Vol) WriteBlob(in io.Reader, loc *BlobLocation, expected_size int64) error {
+	if vol.Packer != nil && expected_size >= 0 && expected_size < vol.Packer.Threshold {
+		return vol.write_packed_blob(in, loc, expected_size)
+	}
+	loc.Pack = ""
+	loc.PackOffset = 0
+	dest := vol.BlobPath(loc.Hash)
+	// Ensure folder exists
+	dir := filepath.Dir(dest)
+	err := os.MkdirAll(dir, os.ModePerm)
+	if err != nil {
+		Log.WarningF("Failed to create '%s' and parent folders: %s", dir, err.Error())
+		return err
+	}
+	// Open destination for writing
+	tmp := dest + ".tmp"
+	fptr_out, err := os.Create(tmp)
+	if err != nil {
+		Log.WarningF("Failed to open '%s' for writing: %s", tmp, err.Error())
+		return err
+	}
+	defer os.Remove(tmp)
+	size, stored_size, err := vol.encode_blob(in, *loc, vol.limit_writer(fptr_out))
+	if err != nil {
+		fptr_out.Close()
+		Log.WarningF("Failed to copy blob '%s' to '%s': %s", loc.Hash, dest, err.Error())
+		return err
+	}
+	err = fptr_out.Close()
+	if err != nil {
+		return err
+	}
+	if size != expected_size && expected_size >= 0 {
+		Log.WarningF("File size reported by os.Lstat (%d bytes) is different from the size copied (%d bytes) for file %s", expected_size, size, dest)
+		return errors.New("file size does not match number of copied bytes")
+	}
+	loc.StoredSize = stored_size
+	return os.Rename(tmp, dest)
+}
+
+// Data flows: in -> codec -> encryption -> out. Returns how many bytes were read and written.
+func (vol Vol) encode_blob(in io.Reader, loc BlobLocation, out_raw io.Writer) (int64, int64, error) {
+	var err error
+	counter := &counting_writer{out: out_raw}
+	var out io.WriteCloser = nop_write_closer{counter}
+	if vol.Encryption != "" {
+		out, err = NewEncWriter(counter, vol.Keys, []byte(loc.Hash))
+		if err != nil {
+			return 0, 0, err
+		}
+	}
+	compressor, err := codec_writer(loc.Codec, out)
+	if err != nil {
+		return 0, 0, err
+	}
+	// Actually copy the file
+	size, err := io.Copy(compressor, in)
+	if err == nil {
+		err = compressor.Close()
+	}
+	if err == nil {
+		err = out.Close()
+	}
+	return size, counter.n, err
+}
+
+// Closes all the layers of a blob
+type blob_reader struct {
+	io.Reader
+	closers []io.Closer
+}
+
+func (r blob_reader) Close() error {
+	var err error
+	for i := len(r.closers) - 1; i >= 0; i-- {
+		if e := r.closers[i].Close(); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// Opens a blob for reading its original (decrypted and decompressed) content
+func (vol Vol) OpenBlob(loc BlobLocation) (io.ReadCloser, error) {
+	fptr, err := os.Open(vol.LocationPath(loc))
+	if err != nil {
+		return nil, err
+	}
+	r := blob_reader{fptr, []io.Closer{fptr}}
+	if loc.Pack != "" {
+		r.Reader = io.NewSectionReader(fptr, loc.PackOffset, loc.StoredSize)
+	}
+	r.Reader = vol.limit_reader(r.Reader)
+	if vol.Encryption != "" {
+		r.Reader, err = NewEncReader(r.Reader, vol.Keys, []byte(loc.Hash))
+		if err != nil {
+			r.Close()
+			return nil, err
+		}
+	}
+	decompressor, err := codec_reader(loc.Codec, r.Reader)
+	if err != nil {
+		r.Close()
+		return nil, err
+	}
+	r.Reader = decompressor
+	r.closers = append(r.closers, decompressor)
+	return r, nil
+}
+
+// Path of the file holding the blob (either the blob itself or its pack)
+func (vol Vol) LocationPath(loc BlobLocation) string {
+	if loc.Pack != "" {
+		return vol.PackPath(loc.Pack)
+	}
+	return vol.BlobPath(loc.Hash)
+}
+
+// Checks the size on disk and the hash of the original content of a blob
+func (vol Vol) CheckBlob(loc BlobLocation, size int64) error {
+	path := vol.LocationPath(loc)
+	info, err := os.Lstat(path)
+	if err != nil {
+		return fmt.Errorf("failed to get file size for '%s': %s", path, err)
+	}
+	stored_size := loc.StoredSize
+	if stored_size == 0 && loc.Codec == CODEC_NONE {
+		// Locations saved before blob compression existed
+		stored_size = vol.BlobStoredSize(size)
+	}
+	if loc.Pack != "" {
+		if info.Size() < loc.PackOffset+stored_size {
+			return fmt.Errorf("pack '%s' is too small (%d bytes) to hold blob '%s' at offset %d", path, info.Size(), loc.Hash, loc.PackOffset)
+		}
+	} else if info.Size() != stored_size {
+		return fmt.Errorf("real file size (%d bytes) is different from the stored size (%d bytes) for file %s", info.Size(), stored_size, path)
+	}
+	fptr, err := vol.OpenBlob(loc)
+	if err != nil {
+		return fmt.Errorf("failed to open '%s': %s", path, err)
+	}
+	defer fptr.Close()
+	real_hash, size_hashed, err := hash_reader_like(loc.Hash, fptr)
+	if err != nil {
+		return fmt.Errorf("failed to hash file '%s': %s", path, err)
+	}
+	if size != size_hashed {
+		return fmt.Errorf("oficial blob size (%d bytes) is different from the size hashed (%d bytes) for file %s", size, size_hashed, path)
+	}
+	if loc.Hash != real_hash {
+		return fmt.Errorf("oficial blob hash does not match the file hash for '%s'", path)
+	}
+	return nil
+}
+
+func LoadBlob(q Querier, hash string) (Blob, error) {
 	blob := Blob{}
-	err := DB.QueryRow("SELECT `hash`, `size`, `volume_uuid` FROM `blobs` WHERE `hash`= ?", hash).Scan(&blob.Hash, &blob.Size, &blob.VolUUID)
+	var first_added int64
+	err := q.QueryRow("SELECT `hash`, `size`, `first_added` FROM `blobs` WHERE `hash`= ?", hash).Scan(&blob.Hash, &blob.Size, &first_added)
 	if err != nil {
 		if err.Error() == "sql: no rows in result set" {
 			err = nil
@@ -29,12 +231,13 @@ func LoadBlob(hash string) (Blob, error) {
 			Log.Warning(err)
 		}
 	}
+	blob.FirstAdded = time.Unix(first_added, 0)
 	return blob, err
 }
 
-func (blob *Blob) Save() error {
+func (blob *Blob) Save(q Querier) error {
 	blob.FirstAdded = time.Now()
-	_, err := DB.Exec("INSERT INTO `blobs` (`hash`, `size`, `volume_uuid`, `first_added`) VALUES (?, ?, ?, ?);", blob.Hash, blob.Size, blob.VolUUID, blob.FirstAdded.Unix())
+	_, err := q.Exec("INSERT INTO `blobs` (`hash`, `size`, `first_added`) VALUES (?, ?, ?);", blob.Hash, blob.Size, blob.FirstAdded.Unix())
 	if err != nil {
 		Log.Warning(err)
 	} else {
@@ -42,3 +245,95 @@ func (blob *Blob) Save() error {
 	}
 	return err
 }
+
+func NewBlobLocation(hash, vol_uuid string) BlobLocation {
+	loc := BlobLocation{}
+	loc.Hash = hash
+	loc.VolUUID = vol_uuid
+	return loc
+}
+
+func LoadBlobLocation(q Querier, hash, vol_uuid string) (BlobLocation, error) {
+	loc, err := ScanBlobLocation(q.QueryRow("SELECT "+BLOB_LOCATION_COLUMNS+" FROM `blob_locations` WHERE `hash` = ? AND `volume_uuid` = ?;", hash, vol_uuid))
+	if err != nil {
+		if err.Error() == "sql: no rows in result set" {
+			err = nil
+		} else {
+			Log.Warning(err)
+		}
+	}
+	return loc, err
+}
+
+const BLOB_LOCATION_COLUMNS = "`blob_locations`.`hash`, `blob_locations`.`volume_uuid`, `blob_locations`.`added`, `blob_locations`.`last_verified`, `blob_locations`.`codec`, `blob_locations`.`stored_size`, `blob_locations`.`pack`, `blob_locations`.`pack_offset`"
+
+func ScanBlobLocation(row RowScanner, extra ...interface{}) (BlobLocation, error) {
+	loc := BlobLocation{}
+	var added, last_verified int64
+	dest := append([]interface{}{&loc.Hash, &loc.VolUUID, &added, &last_verified, &loc.Codec, &loc.StoredSize, &loc.Pack, &loc.PackOffset}, extra...)
+	err := row.Scan(dest...)
+	loc.Added = time.Unix(added, 0)
+	loc.LastVerified = time.Unix(last_verified, 0)
+	return loc, err
+}
+
+// Lists the UUIDs of all volumes that have a copy of the blob (or of all its chunks)
+func LoadBlobVolUUIDs(hash string) ([]string, error) {
+	var n_chunks int
+	err := DB.QueryRow("SELECT COUNT(*) FROM `blob_chunks` WHERE `hash` = ?;", hash).Scan(&n_chunks)
+	if err != nil {
+		Log.Warning(err)
+		return nil, err
+	}
+	var rows *sql.Rows
+	if n_chunks == 0 {
+		rows, err = DB.Query("SELECT `volume_uuid` FROM `blob_locations` WHERE `hash` = ? ORDER BY `added` ASC;", hash)
+	} else {
+		rows, err = DB.Query("SELECT `volume_uuid` FROM `blob_locations` WHERE `hash` IN (SELECT `chunk_hash` FROM `blob_chunks` WHERE `hash` = ?) GROUP BY `volume_uuid` HAVING COUNT(DISTINCT `hash`) = (SELECT COUNT(DISTINCT `chunk_hash`) FROM `blob_chunks` WHERE `hash` = ?) ORDER BY MIN(`added`) ASC;", hash, hash)
+	}
+	if err != nil {
+		Log.Warning(err)
+		return nil, err
+	}
+	defer rows.Close()
+	uuids := make([]string, 0)
+	for rows.Next() {
+		var vol_uuid string
+		err := rows.Scan(&vol_uuid)
+		if err != nil {
+			Log.Warning(err)
+			return nil, err
+		}
+		uuids = append(uuids, vol_uuid)
+	}
+	return uuids, rows.Err()
+}
+
+func (loc *BlobLocation) Save(q Querier) error {
+	loc.Added = time.Now()
+	_, err := q.Exec("INSERT INTO `blob_locations` (`hash`, `volume_uuid`, `added`, `last_verified`, `codec`, `stored_size`, `pack`, `pack_offset`) VALUES (?, ?, ?, ?, ?, ?, ?, ?);", loc.Hash, loc.VolUUID, loc.Added.Unix(), 0, loc.Codec, loc.StoredSize, loc.Pack, loc.PackOffset)
+	if err != nil {
+		Log.Warning(err)
+	} else {
+		Log.DebugF("Saved location of blob '%s' on volume %s to database", loc.Hash, loc.VolUUID)
+	}
+	return err
+}
+
+// Saves how the blob is stored
+func (loc *BlobLocation) Update() error {
+	_, err := DB.Exec("UPDATE `blob_locations` SET `codec` = ?, `stored_size` = ?, `pack` = ?, `pack_offset` = ? WHERE `hash` = ? AND `volume_uuid` = ?;", loc.Codec, loc.StoredSize, loc.Pack, loc.PackOffset, loc.Hash, loc.VolUUID)
+	if err != nil {
+		Log.Warning(err)
+	}
+	return err
+}
+
+func (loc *BlobLocation) MarkVerified() error {
+	loc.LastVerified = time.Now()
+	_, err := DB.Exec("UPDATE `blob_locations` SET `last_verified` = ? WHERE `hash` = ? AND `volume_uuid` = ?;", loc.LastVerified.Unix(), loc.Hash, loc.VolUUID)
+	if err != nil {
+		Log.Warning(err)
+	}
+	return err
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+// Bytes per second allowed to the backup volume (0 means unlimited)
+var FlagBwLimit string
+
+// Spreads the I/O of all goroutines using a device over time, so it never goes above Rate bytes per second
+type BwLimiter struct {
+	Rate float64
+	lock sync.Mutex
+	next time.Time // When the next byte may go through
+}
+
+func NewBwLimiter(rate int64) *BwLimiter {
+	if rate <= 0 {
+		return nil
+	}
+	return &BwLimiter{Rate: float64(rate)}
+}
+
+// Blocks until n bytes may go through
+func (l *BwLimiter) Wait(n int) {
+	if l == nil || n <= 0 {
+		return
+	}
+	l.lock.Lock()
+	// Only a little unused bandwidth is saved for later (this also makes up for sleeping too much)
+	earliest := time.Now().Add(-BW_LIMIT_BURST)
+	if l.next.Before(earliest) {
+		l.next = earliest
+	}
+	start := l.next
+	l.next = l.next.Add(time.Duration(float64(n) / l.Rate * float64(time.Second)))
+	l.lock.Unlock()
+	time.Sleep(time.Until(start))
+}
+
+const BW_LIMIT_BURST = 100 * time.Millisecond
+
+// Data is limited in small pieces, otherwise a big read would stall everyone else
+const BW_LIMIT_PIECE = 64 * 1024
+
+type limited_writer struct {
+	out     io.Writer
+	limiter *BwLimiter
+}
+
+func (w limited_writer) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		piece := p
+		if len(piece) > BW_LIMIT_PIECE {
+			piece = piece[:BW_LIMIT_PIECE]
+		}
+		w.limiter.Wait(len(piece))
+		n, err := w.out.Write(piece)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		p = p[len(piece):]
+	}
+	return written, nil
+}
+
+type limited_reader struct {
+	in      io.Reader
+	limiter *BwLimiter
+}
+
+func (r limited_reader) Read(p []byte) (int, error) {
+	if len(p) > BW_LIMIT_PIECE {
+		p = p[:BW_LIMIT_PIECE]
+	}
+	n, err := r.in.Read(p)
+	r.limiter.Wait(n)
+	return n, err
+}
+
+func (vol Vol) limit_writer(out io.Writer) io.Writer {
+	if vol.Limiter == nil {
+		return out
+	}
+	return limited_writer{out, vol.Limiter}
+}
+
+func (vol Vol) limit_reader(in io.Reader) io.Reader {
+	if vol.Limiter == nil {
+		return in
+	}
+	return limited_reader{in, vol.Limiter}
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"io"
+	"os"
+)
+
+// Content defined chunking (FastCDC with normalized chunking) lets big files that change a little share most of their blobs
+const CHUNK_MIN_SIZE = 512 * 1024
+const CHUNK_AVG_BITS = 21 // 2 MiB
+const CHUNK_AVG_SIZE = 1 << CHUNK_AVG_BITS
+const CHUNK_MAX_SIZE = 8 * 1024 * 1024
+
+// Harder to match before the average size and easier after it, so chunk sizes stay close to the average
+const CHUNK_MASK_SMALL = uint64(1<<(CHUNK_AVG_BITS+2)-1) << (64 - (CHUNK_AVG_BITS + 2))
+const CHUNK_MASK_LARGE = uint64(1<<(CHUNK_AVG_BITS-2)-1) << (64 - (CHUNK_AVG_BITS - 2))
+
+var FlagChunk bool
+var FlagChunkThreshold string
+
+// Files with at least this many bytes are chunked (if chunking is enabled)
+var ChunkThreshold int64
+
+// The gear table MUST never change, otherwise chunks from old backups will not match new ones
+var chunk_gear [256]uint64
+
+func init() {
+	for i := range chunk_gear {
+		sum := sha256.Sum256([]byte{'b', 'l', 'u', '-', 'u', 'p', byte(i)})
+		chunk_gear[i] = binary.BigEndian.Uint64(sum[:8])
+	}
+}
+
+// A piece of a file that is stored as its own blob
+type Chunk struct {
+	Hash   string `json:hash`
+	Offset int64  `json:offset`
+	Size   int64  `json:size`
+}
+
+func should_chunk(size int64) bool {
+	return FlagChunk && size >= ChunkThreshold
+}
+
+// Hashes the whole file and each of its chunks in a single pass
+func hash_and_chunk_file(path string) (string, int64, []Chunk, error) {
+	fptr, err := os.Open(path)
+	if err != nil {
+		Log.WarningF("Failed to open file '%s' for reading: %s ", path, err)
+		return "", 0, nil, err
+	}
+	defer fptr.Close()
+
+	chunks := make([]Chunk, 0)
+	file_hasher := new_hasher()
+	chunk_hasher := new_hasher()
+	chunk := Chunk{}
+	var roll uint64
+	var offset int64
+	buf := make([]byte, 1024*1024)
+	for {
+		n, err := fptr.Read(buf)
+		if n > 0 {
+			file_hasher.Write(buf[:n])
+			start := 0
+			for i := 0; i < n; i++ {
+				chunk.Size++
+				if chunk.Size < CHUNK_MIN_SIZE {
+					continue
+				}
+				roll = (roll << 1) + chunk_gear[buf[i]]
+				mask := CHUNK_MASK_LARGE
+				if chunk.Size < CHUNK_AVG_SIZE {
+					mask = CHUNK_MASK_SMALL
+				}
+				if roll&mask == 0 || chunk.Size >= CHUNK_MAX_SIZE {
+					// Found a boundary
+					chunk_hasher.Write(buf[start : i+1])
+					chunk.Hash = format_hash(chunk_hasher)
+					chunks = append(chunks, chunk)
+					offset += chunk.Size
+					chunk = Chunk{Offset: offset}
+					chunk_hasher = new_hasher()
+					roll = 0
+					start = i + 1
+				}
+			}
+			chunk_hasher.Write(buf[start:n])
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			Log.WarningF("Failed to hash file '%s': %s ", path, err)
+			return "", 0, nil, err
+		}
+	}
+	if chunk.Size > 0 {
+		chunk.Hash = format_hash(chunk_hasher)
+		chunks = append(chunks, chunk)
+		offset += chunk.Size
+	}
+	return format_hash(file_hasher), offset, chunks, nil
+}
+
+// Run it inside a transaction (like *SaveBatch), so the chunks are saved all at once
+func SaveBlobChunks(q Querier, hash string, chunks []Chunk) error {
+	for i, chunk := range chunks {
+		_, err := q.Exec("INSERT INTO `blob_chunks` (`hash`, `idx`, `chunk_hash`, `offset`, `size`) VALUES (?, ?, ?, ?, ?);", hash, i, chunk.Hash, chunk.Offset, chunk.Size)
+		if err != nil {
+			Log.Warning(err)
+			return err
+		}
+	}
+	return nil
+}
+
+// Returns an empty list if the blob is not chunked
+func LoadBlobChunks(q Querier, hash string) ([]Chunk, error) {
+	rows, err := q.Query("SELECT `chunk_hash`, `offset`, `size` FROM `blob_chunks` WHERE `hash` = ? ORDER BY `idx` ASC;", hash)
+	if err != nil {
+		Log.Warning(err)
+		return nil, err
+	}
+	defer rows.Close()
+	chunks := make([]Chunk, 0)
+	for rows.Next() {
+		chunk := Chunk{}
+		err := rows.Scan(&chunk.Hash, &chunk.Offset, &chunk.Size)
+		if err != nil {
+			Log.Warning(err)
+			return nil, err
+		}
+		chunks = append(chunks, chunk)
+	}
+	return chunks, rows.Err()
+}
+
+// Reads the chunks of a file one after the other, opening each one only when needed
+type chunked_reader struct {
+	vol     Vol
+	chunks  []Chunk
+	current io.ReadCloser
+}
+
+func (vol Vol) OpenChunkedBlob(chunks []Chunk) io.ReadCloser {
+	return &chunked_reader{vol: vol, chunks: chunks}
+}
+
+func (r *chunked_reader) Read(p []byte) (int, error) {
+	for {
+		if r.current == nil {
+			if len(r.chunks) == 0 {
+				return 0, io.EOF
+			}
+			loc, err := LoadBlobLocation(DB, r.chunks[0].Hash, r.vol.UUID)
+			if err != nil {
+				return 0, err
+			}
+			if loc.Hash == "" {
+				warn_missing_blob(r.chunks[0].Hash)
+				return 0, io.ErrUnexpectedEOF
+			}
+			r.current, err = r.vol.OpenBlob(loc)
+			if err != nil {
+				return 0, err
+			}
+			r.chunks = r.chunks[1:]
+		}
+		n, err := r.current.Read(p)
+		if err == io.EOF {
+			r.current.Close()
+			r.current = nil
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+		return n, err
+	}
+}
+
+func (r *chunked_reader) Close() error {
+	if r.current != nil {
+		return r.current.Close()
+	}
+	return nil
+}
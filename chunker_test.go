@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+// Writes data to a temporary file and chunks it
+func chunk_bytes(t *testing.T, data []byte) (string, int64, []Chunk) {
+	path := filepath.Join(t.TempDir(), "data")
+	err := ioutil.WriteFile(path, data, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash, size, chunks, err := hash_and_chunk_file(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return hash, size, chunks
+}
+
+func TestChunkBoundaries(t *testing.T) {
+	cases := []struct {
+		name     string
+		data     []byte
+		n_chunks int // 0 means any number
+	}{
+		{"empty", []byte{}, 0},
+		{"smaller than the minimum", random_bytes(1, CHUNK_MIN_SIZE-1), 1},
+		{"random", random_bytes(2, 24*1024*1024), 0},
+		{"zeros", make([]byte, 3*CHUNK_MAX_SIZE+100), 4},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			hash, size, chunks := chunk_bytes(t, c.data)
+			if size != int64(len(c.data)) {
+				t.Fatalf("hashed %d bytes, expected %d", size, len(c.data))
+			}
+			if want, _, _ := hash_reader(bytes.NewReader(c.data)); hash != want {
+				t.Errorf("file hash is %s, expected %s", hash, want)
+			}
+			if c.n_chunks != 0 && len(chunks) != c.n_chunks {
+				t.Errorf("got %d chunks, expected %d", len(chunks), c.n_chunks)
+			}
+			var offset int64
+			for i, chunk := range chunks {
+				if chunk.Offset != offset {
+					t.Fatalf("chunk %d starts at %d, expected %d", i, chunk.Offset, offset)
+				}
+				last := i == len(chunks)-1
+				if chunk.Size > CHUNK_MAX_SIZE || (!last && chunk.Size < CHUNK_MIN_SIZE) {
+					t.Errorf("chunk %d has %d bytes", i, chunk.Size)
+				}
+				want, _, _ := hash_reader(bytes.NewReader(c.data[chunk.Offset : chunk.Offset+chunk.Size]))
+				if chunk.Hash != want {
+					t.Errorf("chunk %d hash is %s, expected %s", i, chunk.Hash, want)
+				}
+				offset += chunk.Size
+			}
+			if offset != size {
+				t.Errorf("chunks cover %d bytes, expected %d", offset, size)
+			}
+		})
+	}
+}
+
+// Inserting bytes at the start of a file must only change the first chunk
+func TestChunkBoundariesShift(t *testing.T) {
+	data := random_bytes(3, 24*1024*1024)
+	_, _, before := chunk_bytes(t, data)
+	_, _, after := chunk_bytes(t, append([]byte("a few new bytes"), data...))
+	old := make(map[string]bool)
+	for _, chunk := range before {
+		old[chunk.Hash] = true
+	}
+	n_shared := 0
+	for _, chunk := range after {
+		if old[chunk.Hash] {
+			n_shared++
+		}
+	}
+	if len(before) < 3 || n_shared < len(before)-1 {
+		t.Errorf("only %d of %d chunks are shared after the insertion", n_shared, len(before))
+	}
+}
+
+func TestChunkedBlobReassembly(t *testing.T) {
+	open_test_db(t)
+	if err := MigrateDB(); err != nil {
+		t.Fatal(err)
+	}
+	data := random_bytes(4, 12*1024*1024)
+	_, _, chunks := chunk_bytes(t, data)
+	vol := Vol{UUID: "test-vol", Dir: t.TempDir()}
+	for _, chunk := range chunks {
+		loc := NewBlobLocation(chunk.Hash, vol.UUID)
+		err := vol.WriteBlob(bytes.NewReader(data[chunk.Offset:chunk.Offset+chunk.Size]), &loc, chunk.Size)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := loc.Save(DB); err != nil {
+			t.Fatal(err)
+		}
+	}
+	reader := vol.OpenChunkedBlob(chunks)
+	defer reader.Close()
+	got, err := ioutil.ReadAll(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Errorf("reassembled %d bytes that do not match the %d bytes chunked", len(got), len(data))
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Codecs used to store blobs on volumes (empty means the blob is stored as is)
+const CODEC_NONE = ""
+const CODEC_GZIP = "gzip"
+const CODEC_ZSTD = "zstd"
+
+// Codec used for new blobs on this backup
+var BackupCodec string
+var FlagCompress string
+
+// Files that are (almost always) already compressed
+var CompressedExtensions []string = []string{".7z", ".apk", ".avi", ".bz2", ".docx", ".flac", ".gif", ".gz", ".heic", ".jar", ".jpeg", ".jpg", ".m4a", ".mkv", ".mov", ".mp3", ".mp4", ".odp", ".ods", ".odt", ".ogg", ".opus", ".png", ".pptx", ".rar", ".tgz", ".webm", ".webp", ".xlsx", ".xz", ".zip", ".zst"}
+var CompressedMagics [][]byte = [][]byte{
+	{0x1f, 0x8b},                  // gzip
+	{0x28, 0xb5, 0x2f, 0xfd},      // zstd
+	{0xfd, '7', 'z', 'X', 'Z', 0}, // xz
+	{'B', 'Z', 'h'},               // bzip2
+	{'P', 'K', 0x03, 0x04},        // zip (and docx, jar, etc.)
+	{'7', 'z', 0xbc, 0xaf, 0x27},  // 7z
+	{'R', 'a', 'r', '!'},          // rar
+	{0x89, 'P', 'N', 'G'},         // png
+	{0xff, 0xd8, 0xff},            // jpeg
+	{'G', 'I', 'F', '8'},          // gif
+	{0x1a, 0x45, 0xdf, 0xa3},      // matroska and webm
+	{'O', 'g', 'g', 'S'},          // ogg
+	{'f', 'L', 'a', 'C'},          // flac
+	{'I', 'D', '3'},               // mp3
+}
+
+// Converts the name given by the user into a codec
+func ParseCodec(name string) (string, error) {
+	switch strings.ToLower(name) {
+	case "", "none":
+		return CODEC_NONE, nil
+	case CODEC_GZIP:
+		return CODEC_GZIP, nil
+	case CODEC_ZSTD:
+		return CODEC_ZSTD, nil
+	}
+	return "", errors.New("unknown compression codec: " + name)
+}
+
+// Tells whether compressing the file is pointless
+func is_compressed(path string, head []byte) bool {
+	if ContainsStr(CompressedExtensions, strings.ToLower(filepath.Ext(path))) {
+		return true
+	}
+	for _, magic := range CompressedMagics {
+		if bytes.HasPrefix(head, magic) {
+			return true
+		}
+	}
+	// mp4, mov, heic, etc.
+	if len(head) >= 8 && string(head[4:8]) == "ftyp" {
+		return true
+	}
+	return false
+}
+
+// Picks the codec for a blob given its path and first bytes
+func choose_codec(path string, head []byte) string {
+	if BackupCodec == CODEC_NONE || is_compressed(path, head) {
+		return CODEC_NONE
+	}
+	return BackupCodec
+}
+
+type nop_write_closer struct {
+	io.Writer
+}
+
+func (nop_write_closer) Close() error {
+	return nil
+}
+
+// Close MUST be called to flush the compressed data (but it does not close out)
+func codec_writer(codec string, out io.Writer) (io.WriteCloser, error) {
+	switch codec {
+	case CODEC_NONE:
+		return nop_write_closer{out}, nil
+	case CODEC_GZIP:
+		return gzip.NewWriter(out), nil
+	case CODEC_ZSTD:
+		return zstd.NewWriter(out)
+	}
+	return nil, errors.New("unknown compression codec: " + codec)
+}
+
+type zstd_read_closer struct {
+	*zstd.Decoder
+}
+
+func (r zstd_read_closer) Close() error {
+	r.Decoder.Close()
+	return nil
+}
+
+func codec_reader(codec string, in io.Reader) (io.ReadCloser, error) {
+	switch codec {
+	case CODEC_NONE:
+		return ioutil.NopCloser(in), nil
+	case CODEC_GZIP:
+		return gzip.NewReader(in)
+	case CODEC_ZSTD:
+		dec, err := zstd.NewReader(in)
+		if err != nil {
+			return nil, err
+		}
+		return zstd_read_closer{dec}, nil
+	}
+	return nil, errors.New("unknown compression codec: " + codec)
+}
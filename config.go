@@ -0,0 +1,145 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/pelletier/go-toml"
+	"github.com/spf13/cobra"
+)
+
+var FlagConfig string
+var FlagProfile string
+
+// Names that read better on a config file than the flag names
+var ConfigAliases map[string]string = map[string]string{
+	"volume":   "vol",
+	"excludes": "exclude",
+	"includes": "include",
+}
+
+// Aliases that only make sense for some commands. The volume folder is --to for backup and verify, but --vol-dir for restore (whose --to is where files are written).
+var CommandConfigAliases map[string]map[string]string = map[string]map[string]string{
+	"backup":  {"source": "from", "mount": "to"},
+	"verify":  {"mount": "to"},
+	"restore": {"mount": "vol-dir"},
+}
+
+// Flags that mean different things for each command, so they are only read from command sections (like [backup] or [profiles.photos.restore])
+var CommandOnlyOptions map[string]bool = map[string]bool{
+	"to":   true,
+	"from": true,
+}
+
+func default_config_path() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "blu-up", "config.toml")
+}
+
+// Fills the flags not given on the command line with the values of the profile (if any) and then with the top level values of the config file. Values of the section named after the command win over the ones around it.
+func LoadConfig(cmd *cobra.Command) error {
+	path := FlagConfig
+	if path == "" {
+		path = default_config_path()
+		if _, err := os.Stat(path); path == "" || os.IsNotExist(err) {
+			if FlagProfile != "" {
+				return fmt.Errorf("profile '%s' needs a config file (use --config or create '%s')", FlagProfile, path)
+			}
+			return nil
+		}
+	}
+	tree, err := toml.LoadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read config file '%s': %s", path, err)
+	}
+	Log.DebugF("Loaded config file '%s'", path)
+	conf := tree.ToMap()
+	profiles, _ := conf["profiles"].(map[string]interface{})
+	delete(conf, "profiles")
+	if FlagProfile != "" {
+		profile, ok := profiles[FlagProfile].(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("profile '%s' not found on '%s'", FlagProfile, path)
+		}
+		err = apply_config(cmd, config_section(cmd, profile), "profile '"+FlagProfile+"'", true)
+		if err != nil {
+			return err
+		}
+		err = apply_config(cmd, profile, "profile '"+FlagProfile+"'", false)
+		if err != nil {
+			return err
+		}
+	}
+	err = apply_config(cmd, config_section(cmd, conf), "section ["+cmd.Name()+"]", true)
+	if err != nil {
+		return err
+	}
+	// Top level values are for every command, so they are not an error if the command lacks the flag
+	return apply_config(cmd, conf, "", false)
+}
+
+// Only top level commands have sections (sub-commands like snapshot rm and vol rm share names)
+func config_section(cmd *cobra.Command, values map[string]interface{}) map[string]interface{} {
+	if !cmd.HasParent() || cmd.Parent() != cmd.Root() {
+		return nil
+	}
+	section, _ := values[cmd.Name()].(map[string]interface{})
+	return section
+}
+
+// Setting a flag marks it as changed, so values applied first win over the ones applied later
+func apply_config(cmd *cobra.Command, values map[string]interface{}, strict_name string, in_section bool) error {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		// Sections are applied on their own
+		if _, ok := values[key].(map[string]interface{}); ok {
+			continue
+		}
+		name := strings.Replace(key, "_", "-", -1)
+		if CommandOnlyOptions[name] && !in_section {
+			return fmt.Errorf("option '%s' must be on a command section, like [backup] or [restore] (use 'source' and 'mount' for backups)", key)
+		}
+		if alias, ok := CommandConfigAliases[cmd.Name()][name]; ok {
+			name = alias
+		} else if alias, ok := ConfigAliases[name]; ok {
+			name = alias
+		}
+		flag := cmd.Flags().Lookup(name)
+		if flag == nil {
+			if strict_name != "" {
+				return fmt.Errorf("unknown option '%s' on %s", key, strict_name)
+			}
+			continue
+		}
+		if flag.Changed {
+			continue
+		}
+		vals, ok := values[key].([]interface{})
+		if !ok {
+			vals = []interface{}{values[key]}
+		}
+		for _, val := range vals {
+			str := fmt.Sprint(val)
+			if strings.HasPrefix(str, "~/") {
+				if home, err := os.UserHomeDir(); err == nil {
+					str = filepath.Join(home, str[2:])
+				}
+			}
+			err := cmd.Flags().Set(name, str)
+			if err != nil {
+				return fmt.Errorf("invalid value for '%s': %s", key, err)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/spf13/cobra"
+)
+
+type config_test_cmds struct {
+	backup, restore                             *cobra.Command
+	backup_from, backup_to, restore_to, vol_dir string
+}
+
+// Commands with the flags whose meaning changes between backup and restore
+func new_config_test_cmds() *config_test_cmds {
+	c := &config_test_cmds{}
+	root := &cobra.Command{Use: "blu-up"}
+	c.backup = &cobra.Command{Use: "backup"}
+	c.restore = &cobra.Command{Use: "restore"}
+	root.AddCommand(c.backup, c.restore)
+	c.backup.Flags().StringVar(&c.backup_from, "from", "", "")
+	c.backup.Flags().StringVar(&c.backup_to, "to", "", "")
+	c.restore.Flags().StringVar(&c.vol_dir, "vol-dir", "", "")
+	c.restore.Flags().StringVar(&c.restore_to, "to", "", "")
+	return c
+}
+
+func load_test_config(t *testing.T, config, profile string) (*config_test_cmds, error, error) {
+	old_config, old_profile := FlagConfig, FlagProfile
+	defer func() { FlagConfig, FlagProfile = old_config, old_profile }()
+	FlagConfig = filepath.Join(t.TempDir(), "config.toml")
+	FlagProfile = profile
+	if err := ioutil.WriteFile(FlagConfig, []byte(config), 0644); err != nil {
+		t.Fatal(err)
+	}
+	c := new_config_test_cmds()
+	return c, LoadConfig(c.backup), LoadConfig(c.restore)
+}
+
+func TestConfigMountIsNotRestoreDestination(t *testing.T) {
+	c, err_backup, err_restore := load_test_config(t, "source = \"/home/me\"\nmount = \"/media/disk\"\n", "")
+	if err_backup != nil || err_restore != nil {
+		t.Fatal(err_backup, err_restore)
+	}
+	if c.backup_from != "/home/me" || c.backup_to != "/media/disk" {
+		t.Errorf("backup got --from %q and --to %q", c.backup_from, c.backup_to)
+	}
+	if c.restore_to != "" || c.vol_dir != "/media/disk" {
+		t.Errorf("restore got --to %q and --vol-dir %q", c.restore_to, c.vol_dir)
+	}
+}
+
+func TestConfigCommandSections(t *testing.T) {
+	config := "[backup]\nto = \"/media/disk\"\n[restore]\nto = \"/tmp/restored\"\n[profiles.photos]\nmount = \"/media/usb\"\n[profiles.photos.restore]\nto = \"/tmp/photos\"\n"
+	c, err_backup, err_restore := load_test_config(t, config, "")
+	if err_backup != nil || err_restore != nil {
+		t.Fatal(err_backup, err_restore)
+	}
+	if c.backup_to != "/media/disk" || c.restore_to != "/tmp/restored" {
+		t.Errorf("backup got --to %q and restore got --to %q", c.backup_to, c.restore_to)
+	}
+	c, err_backup, err_restore = load_test_config(t, config, "photos")
+	if err_backup != nil || err_restore != nil {
+		t.Fatal(err_backup, err_restore)
+	}
+	if c.backup_to != "/media/usb" || c.restore_to != "/tmp/photos" || c.vol_dir != "/media/usb" {
+		t.Errorf("backup got --to %q, restore got --to %q and --vol-dir %q", c.backup_to, c.restore_to, c.vol_dir)
+	}
+}
+
+func TestConfigToOutsideSection(t *testing.T) {
+	cases := []struct {
+		config, profile string
+	}{
+		{"to = \"/media/disk\"\n", ""},
+		{"[profiles.photos]\nfrom = \"/home/me\"\n", "photos"},
+	}
+	for _, c := range cases {
+		_, err_backup, err_restore := load_test_config(t, c.config, c.profile)
+		if err_backup == nil || err_restore == nil {
+			t.Errorf("%q was accepted", c.config)
+		}
+	}
+}
@@ -1,112 +1,135 @@
 package main
 
 import (
-	"errors"
+	"bufio"
+	"bytes"
 	"io"
 	"os"
-	"path/filepath"
+	"sync"
 )
 
 type CopyOrder struct {
 	Origin string
+	Data   []byte // Set for archives kept in memory (Origin is then the packed folder)
 	Dest   string
+	Offset int64 // Where the blob starts in Origin (chunks of big files)
 	Size   int64
 	Hash   string
+	Loc    BlobLocation // Set once the blob is written
 }
 
 var CopierCh chan CopyOrder
 var CopierDoneCh chan bool
+var CopierCheckCh chan CopyOrder
+var CopierWG *sync.WaitGroup
+var CopierCheckWG *sync.WaitGroup
+var CopyWorkers int
 var BackupToFolder string
 var BackupFromFolder string
 var BackupVolUUID string
 var BackupVolName string
+var BackupVol Vol
 
-func AddToCopier(origin, hash string, size int64) {
+func NewCopyOrder(origin, hash string, size, offset int64) CopyOrder {
 	order := CopyOrder{}
+	order.Offset = offset
 	order.Size = size
 	order.Origin = origin
-	order.Dest = BackupToFolder + "/" + Hash2Path(hash)
+	order.Dest = BackupVol.BlobPath(hash)
 	order.Hash = hash
 	Log.Debug("Added to CoperCh: " + origin)
-	CopierCh <- order
+	return order
+}
+
+// Starts n workers that write blobs and n that read them back for checking, so writing a blob overlaps with checking the previous one
+func start_copiers(n int) {
+	if n < 1 {
+		n = 1
+	}
+	CopierCheckCh = make(chan CopyOrder, n)
+	CopierWG = &sync.WaitGroup{}
+	CopierCheckWG = &sync.WaitGroup{}
+	CopierWG.Add(n)
+	CopierCheckWG.Add(n)
+	for i := 0; i < n; i++ {
+		go copier_consumer()
+		go copier_checker()
+	}
+	go func() {
+		CopierWG.Wait()
+		close(CopierCheckCh)
+		CopierCheckWG.Wait()
+		Log.Notice("Finished copying blobs to " + BackupToFolder)
+		CopierDoneCh <- true
+	}()
 }
 
 func copier_consumer() {
-	// Do NOT run more than one of this
+	defer CopierWG.Done()
 	for {
 		order, more := <-CopierCh
 		if !more {
-			Log.Notice("Finished copying blobs to " + BackupToFolder)
-			CopierDoneCh <- true
 			return
 		}
-		err := copier_main(order)
-		if err != nil {
-			Log.ErrorF(err.Error())
-			continue
-		}
-		// Verify file size
-		info, err := os.Lstat(order.Dest)
+		err := copier_main(&order)
+		unstage(order.Origin, order.Data)
 		if err != nil {
-			Log.ErrorF("Failed to get file size for '%s': %s ", order.Dest, err.Error())
+			copier_failed(order, err)
 			continue
 		}
-		if info.Size() != order.Size {
-			Log.ErrorF("Original file size (%d bytes) is different from copied file size (%d bytes) for file %s", order.Size, info.Size(), order.Dest)
-			continue
+		CopierCheckCh <- order
+	}
+}
+
+func copier_checker() {
+	defer CopierCheckWG.Done()
+	for {
+		order, more := <-CopierCheckCh
+		if !more {
+			return
 		}
-		//  Double check everything
-		hash, size_hashed, err := hash_file(order.Dest)
+		err := copier_check(order.Loc, order.Size)
 		if err != nil {
-			Log.ErrorF("Failed to hash file '%s': %s", order.Dest, err.Error())
-			continue
-		}
-		if order.Size != size_hashed {
-			Log.WarningF("Oficial blob size (%d bytes) is different from the size hashed (%d bytes)", order.Size, size_hashed)
-			continue
-		}
-		if order.Hash != hash {
-			Log.WarningF("Oficial blob hash does not match copied file hash")
+			copier_failed(order, err)
 			continue
 		}
+		// Only now the volume has the blob
+		SaverBatch.Copied(order.Loc)
 	}
 }
 
-func copier_main(order CopyOrder) error {
-	// Ensure folder exists
-	dir := filepath.Dir(order.Dest)
-	err := os.MkdirAll(dir, os.ModePerm)
-	if err != nil {
-		Log.WarningF("Failed to create '%s' and parent folders: %s", dir, err.Error())
-		return err
-	}
-	return copy_file(order.Origin, order.Dest, order.Size)
+func copier_failed(order CopyOrder, err error) {
+	Log.ErrorF("Failed to copy blob '%s' to volume %s: %s", order.Hash, BackupVolUUID, err)
+	SaverBatch.CopyFailed(order.Hash)
+	BackupSnapshot.AddError()
 }
 
-func copy_file(from, to string, expected_size int64) error {
-	// Open source file for reading
-	fptr_in, err := os.Open(from)
-	defer fptr_in.Close()
-	if err != nil {
-		Log.WarningF("Failed to open '%s' for reading: %s", from, err.Error())
-		return err
-	}
-	// Open destination for writing
-	fptr_out, err := os.Create(to)
-	defer fptr_out.Close()
-	if err != nil {
-		Log.WarningF("Failed to open '%s' for writing: %s", to, err.Error())
-		return err
-	}
-	// Actually copy the file
-	size, err := io.Copy(fptr_out, fptr_in)
+// Double checks a copied blob
+func copier_check(loc BlobLocation, size int64) error {
+	err := BackupVol.CheckBlob(loc, size)
 	if err != nil {
-		Log.WarningF("Failed to copy '%s' to '%s': %s", from, to, err.Error())
-		return err
+		Log.ErrorF("Copied blob '%s' is broken: %s", loc.Hash, err)
 	}
-	if size != expected_size && expected_size >= 0 {
-		Log.WarningF("File size reported by os.Lstat (%d bytes) is different from the size copied (%d bytes) for file %s", expected_size, size, to)
-		return errors.New("file size does not match number of hashed bytes")
+	return err
+}
+
+// Writes the blob to the volume and sets order.Loc
+func copier_main(order *CopyOrder) error {
+	var origin io.ReaderAt = bytes.NewReader(order.Data)
+	if order.Data == nil {
+		// Open source file for reading
+		fptr_in, err := os.Open(order.Origin)
+		if err != nil {
+			Log.WarningF("Failed to open '%s' for reading: %s", order.Origin, err.Error())
+			return err
+		}
+		defer fptr_in.Close()
+		origin = fptr_in
 	}
-	return nil
+	// Peek the first bytes to know whether compression is worth it
+	in := bufio.NewReader(io.NewSectionReader(origin, order.Offset, order.Size))
+	head, _ := in.Peek(512)
+	order.Loc = NewBlobLocation(order.Hash, BackupVolUUID)
+	order.Loc.Codec = choose_codec(order.Origin, head)
+	return BackupVol.WriteBlob(in, &order.Loc, order.Size)
 }
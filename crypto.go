@@ -0,0 +1,325 @@
+package main
+
+import (
+	"bufio"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
+	"golang.org/x/crypto/scrypt"
+	"golang.org/x/term"
+)
+
+// Blobs are encrypted in segments with XChaCha20-Poly1305 (STREAM construction), the volume key is protected by a passphrase using scrypt
+const ENC_SCHEME_XCHACHA20 = "xchacha20poly1305"
+const ENC_KEY_FILE = ".blu-up-key"
+const ENC_MAGIC = "BLUENC1\x00"
+const ENC_SEGMENT_SIZE = 64 * 1024
+const ENC_NONCE_PREFIX_SIZE = 16
+const ENC_HEADER_SIZE = len(ENC_MAGIC) + ENC_NONCE_PREFIX_SIZE
+
+var FlagPassphraseFile string
+
+// Stored at the root of encrypted volumes
+type KeyFile struct {
+	Version int    `json:"version"`
+	Scheme  string `json:"scheme"`
+	KDF     string `json:"kdf"`
+	N       int    `json:"n"`
+	R       int    `json:"r"`
+	P       int    `json:"p"`
+	Salt    []byte `json:"salt"`
+	Nonce   []byte `json:"nonce"`
+	Key     []byte `json:"key"` // Master key sealed with the passphrase derived key
+}
+
+// Keys derived from the volume master key
+type VolKeys struct {
+	Blob []byte // Encrypts the blobs
+	Name []byte // Hides the hashes in blob paths
+}
+
+// Gets the passphrase from --passphrase-file, BLU_UP_PASSPHRASE or the terminal (in this order)
+func get_passphrase(prompt string, confirm bool) ([]byte, error) {
+	if FlagPassphraseFile != "" {
+		data, err := ioutil.ReadFile(FlagPassphraseFile)
+		if err != nil {
+			return nil, err
+		}
+		return []byte(strings.TrimRight(string(data), "\r\n")), nil
+	}
+	if env := os.Getenv("BLU_UP_PASSPHRASE"); env != "" {
+		return []byte(env), nil
+	}
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		return nil, errors.New("no passphrase given (use --passphrase-file or BLU_UP_PASSPHRASE)")
+	}
+	fmt.Fprint(os.Stderr, prompt+": ")
+	pass, err := term.ReadPassword(fd)
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return nil, err
+	}
+	if confirm {
+		fmt.Fprint(os.Stderr, "Confirm passphrase: ")
+		pass2, err := term.ReadPassword(fd)
+		fmt.Fprintln(os.Stderr)
+		if err != nil {
+			return nil, err
+		}
+		if string(pass) != string(pass2) {
+			return nil, errors.New("passphrases do not match")
+		}
+	}
+	if len(pass) == 0 {
+		return nil, errors.New("empty passphrase")
+	}
+	return pass, nil
+}
+
+func derive_vol_keys(master []byte) (VolKeys, error) {
+	keys := VolKeys{}
+	kdf := hkdf.New(sha256.New, master, nil, []byte("blu-up blob key"))
+	keys.Blob = make([]byte, chacha20poly1305.KeySize)
+	if _, err := io.ReadFull(kdf, keys.Blob); err != nil {
+		return keys, err
+	}
+	kdf = hkdf.New(sha256.New, master, nil, []byte("blu-up name key"))
+	keys.Name = make([]byte, 32)
+	if _, err := io.ReadFull(kdf, keys.Name); err != nil {
+		return keys, err
+	}
+	return keys, nil
+}
+
+// Generates a new master key and saves it (protected by the passphrase) on the volume folder
+func CreateKeyFile(dir string, passphrase []byte) error {
+	path := filepath.Join(dir, ENC_KEY_FILE)
+	if _, err := os.Lstat(path); err == nil {
+		return errors.New("key file already exists: " + path)
+	}
+	kf := KeyFile{Version: 1, Scheme: ENC_SCHEME_XCHACHA20, KDF: "scrypt", N: 1 << 15, R: 8, P: 1}
+	kf.Salt = make([]byte, 32)
+	kf.Nonce = make([]byte, chacha20poly1305.NonceSizeX)
+	master := make([]byte, 32)
+	for _, buf := range [][]byte{kf.Salt, kf.Nonce, master} {
+		if _, err := rand.Read(buf); err != nil {
+			return err
+		}
+	}
+	aead, err := key_file_aead(kf, passphrase)
+	if err != nil {
+		return err
+	}
+	kf.Key = aead.Seal(nil, kf.Nonce, master, []byte(kf.Scheme))
+	data, err := json.MarshalIndent(kf, "", "\t")
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(dir, os.ModePerm)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, data, 0600)
+}
+
+func LoadKeyFile(dir string, passphrase []byte) (VolKeys, error) {
+	path := filepath.Join(dir, ENC_KEY_FILE)
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return VolKeys{}, err
+	}
+	kf := KeyFile{}
+	err = json.Unmarshal(data, &kf)
+	if err != nil {
+		return VolKeys{}, err
+	}
+	if kf.Scheme != ENC_SCHEME_XCHACHA20 || kf.KDF != "scrypt" {
+		return VolKeys{}, errors.New("unsupported key file scheme: " + kf.Scheme + "/" + kf.KDF)
+	}
+	aead, err := key_file_aead(kf, passphrase)
+	if err != nil {
+		return VolKeys{}, err
+	}
+	master, err := aead.Open(nil, kf.Nonce, kf.Key, []byte(kf.Scheme))
+	if err != nil {
+		return VolKeys{}, errors.New("wrong passphrase or corrupted key file")
+	}
+	return derive_vol_keys(master)
+}
+
+func key_file_aead(kf KeyFile, passphrase []byte) (cipher.AEAD, error) {
+	key, err := scrypt.Key(passphrase, kf.Salt, kf.N, kf.R, kf.P, chacha20poly1305.KeySize)
+	if err != nil {
+		return nil, err
+	}
+	return chacha20poly1305.NewX(key)
+}
+
+// Path of a blob inside an encrypted volume (the hash itself is not revealed)
+func EncHash2Path(keys VolKeys, src_hash string) string {
+	mac := hmac.New(sha256.New, keys.Name)
+	mac.Write([]byte(src_hash))
+	name := hex.EncodeToString(mac.Sum(nil))
+	return "ENC/" + name[0:3] + "/" + name[3:6] + "/" + name
+}
+
+// Size on disk of an encrypted blob (there is always at least one segment)
+func enc_stored_size(size int64) int64 {
+	n_segments := (size + ENC_SEGMENT_SIZE - 1) / ENC_SEGMENT_SIZE
+	if n_segments == 0 {
+		n_segments = 1
+	}
+	return int64(ENC_HEADER_SIZE) + size + n_segments*chacha20poly1305.Overhead
+}
+
+// Nonce = random prefix (16 bytes) + segment counter (7 bytes) + last segment flag (1 byte)
+func enc_segment_nonce(prefix []byte, counter uint64, last bool) []byte {
+	nonce := make([]byte, chacha20poly1305.NonceSizeX)
+	copy(nonce, prefix)
+	var counter_bytes [8]byte
+	binary.BigEndian.PutUint64(counter_bytes[:], counter)
+	copy(nonce[ENC_NONCE_PREFIX_SIZE:], counter_bytes[1:])
+	if last {
+		nonce[len(nonce)-1] = 1
+	}
+	return nonce
+}
+
+// Encrypts everything written to it, Close MUST be called to write the last segment
+type EncWriter struct {
+	out     io.Writer
+	aead    cipher.AEAD
+	ad      []byte
+	prefix  []byte
+	counter uint64
+	buf     []byte
+}
+
+// The additional data (usually the blob hash) binds the ciphertext to its blob
+func NewEncWriter(out io.Writer, keys VolKeys, ad []byte) (*EncWriter, error) {
+	aead, err := chacha20poly1305.NewX(keys.Blob)
+	if err != nil {
+		return nil, err
+	}
+	w := &EncWriter{out: out, aead: aead, ad: ad}
+	w.prefix = make([]byte, ENC_NONCE_PREFIX_SIZE)
+	if _, err := rand.Read(w.prefix); err != nil {
+		return nil, err
+	}
+	if _, err := out.Write([]byte(ENC_MAGIC)); err != nil {
+		return nil, err
+	}
+	if _, err := out.Write(w.prefix); err != nil {
+		return nil, err
+	}
+	w.buf = make([]byte, 0, ENC_SEGMENT_SIZE)
+	return w, nil
+}
+
+func (w *EncWriter) Write(p []byte) (int, error) {
+	n := 0
+	for len(p) > 0 {
+		// Only flush full segments when we know there is more data, so the last one is always flushed by Close
+		if len(w.buf) == ENC_SEGMENT_SIZE {
+			if err := w.flush(false); err != nil {
+				return n, err
+			}
+		}
+		m := copy(w.buf[len(w.buf):ENC_SEGMENT_SIZE], p)
+		w.buf = w.buf[:len(w.buf)+m]
+		p = p[m:]
+		n += m
+	}
+	return n, nil
+}
+
+func (w *EncWriter) flush(last bool) error {
+	nonce := enc_segment_nonce(w.prefix, w.counter, last)
+	w.counter++
+	_, err := w.out.Write(w.aead.Seal(nil, nonce, w.buf, w.ad))
+	w.buf = w.buf[:0]
+	return err
+}
+
+func (w *EncWriter) Close() error {
+	return w.flush(true)
+}
+
+// Decrypts and authenticates a blob written by EncWriter
+type EncReader struct {
+	in      *bufio.Reader
+	aead    cipher.AEAD
+	ad      []byte
+	prefix  []byte
+	counter uint64
+	buf     []byte
+	done    bool
+}
+
+func NewEncReader(in io.Reader, keys VolKeys, ad []byte) (*EncReader, error) {
+	aead, err := chacha20poly1305.NewX(keys.Blob)
+	if err != nil {
+		return nil, err
+	}
+	r := &EncReader{in: bufio.NewReader(in), aead: aead, ad: ad}
+	header := make([]byte, ENC_HEADER_SIZE)
+	if _, err := io.ReadFull(r.in, header); err != nil {
+		return nil, errors.New("encrypted blob is too short")
+	}
+	if string(header[:len(ENC_MAGIC)]) != ENC_MAGIC {
+		return nil, errors.New("blob is not encrypted or is corrupted")
+	}
+	r.prefix = header[len(ENC_MAGIC):]
+	return r, nil
+}
+
+func (r *EncReader) Read(p []byte) (int, error) {
+	for len(r.buf) == 0 {
+		if r.done {
+			return 0, io.EOF
+		}
+		if err := r.next_segment(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
+
+func (r *EncReader) next_segment() error {
+	segment := make([]byte, ENC_SEGMENT_SIZE+chacha20poly1305.Overhead)
+	n, err := io.ReadFull(r.in, segment)
+	last := false
+	if err == io.ErrUnexpectedEOF || err == io.EOF {
+		last = true
+	} else if err != nil {
+		return err
+	} else if _, err := r.in.Peek(1); err == io.EOF {
+		last = true
+	}
+	nonce := enc_segment_nonce(r.prefix, r.counter, last)
+	r.counter++
+	plain, err := r.aead.Open(segment[:0], nonce, segment[:n], r.ad)
+	if err != nil {
+		return errors.New("encrypted blob failed authentication (corrupted, truncated or wrong key)")
+	}
+	r.buf = plain
+	r.done = last
+	return nil
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+)
+
+func test_vol_keys(t *testing.T) VolKeys {
+	keys, err := derive_vol_keys(bytes.Repeat([]byte{7}, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return keys
+}
+
+func encrypt_bytes(t *testing.T, keys VolKeys, data, ad []byte) []byte {
+	out := &bytes.Buffer{}
+	w, err := NewEncWriter(out, keys, ad)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return out.Bytes()
+}
+
+func decrypt_bytes(keys VolKeys, data, ad []byte) ([]byte, error) {
+	r, err := NewEncReader(bytes.NewReader(data), keys, ad)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadAll(r)
+}
+
+func TestEncRoundTrip(t *testing.T) {
+	keys := test_vol_keys(t)
+	ad := []byte("SHA3-512:abc")
+	for _, size := range []int{0, 1, ENC_SEGMENT_SIZE - 1, ENC_SEGMENT_SIZE, ENC_SEGMENT_SIZE + 1, 3 * ENC_SEGMENT_SIZE, 3*ENC_SEGMENT_SIZE + 17} {
+		data := random_bytes(int64(size), size)
+		enc := encrypt_bytes(t, keys, data, ad)
+		if int64(len(enc)) != enc_stored_size(int64(size)) {
+			t.Errorf("size %d: encrypted into %d bytes, expected %d", size, len(enc), enc_stored_size(int64(size)))
+		}
+		dec, err := decrypt_bytes(keys, enc, ad)
+		if err != nil {
+			t.Errorf("size %d: %s", size, err)
+			continue
+		}
+		if !bytes.Equal(dec, data) {
+			t.Errorf("size %d: decrypted data does not match", size)
+		}
+	}
+}
+
+func TestEncTamper(t *testing.T) {
+	keys := test_vol_keys(t)
+	ad := []byte("SHA3-512:abc")
+	data := random_bytes(5, 2*ENC_SEGMENT_SIZE+100)
+	enc := encrypt_bytes(t, keys, data, ad)
+	segment := ENC_SEGMENT_SIZE + 16
+	cases := []struct {
+		name   string
+		tamper func([]byte) []byte
+		ad     []byte
+		keys   VolKeys
+	}{
+		{"flipped bit", func(b []byte) []byte { b[ENC_HEADER_SIZE+10] ^= 1; return b }, ad, keys},
+		{"flipped nonce prefix", func(b []byte) []byte { b[len(ENC_MAGIC)] ^= 1; return b }, ad, keys},
+		{"truncated at a segment", func(b []byte) []byte { return b[:ENC_HEADER_SIZE+segment] }, ad, keys},
+		{"truncated inside a segment", func(b []byte) []byte { return b[:len(b)-5] }, ad, keys},
+		{"segments swapped", func(b []byte) []byte {
+			first := append([]byte{}, b[ENC_HEADER_SIZE:ENC_HEADER_SIZE+segment]...)
+			copy(b[ENC_HEADER_SIZE:], b[ENC_HEADER_SIZE+segment:ENC_HEADER_SIZE+2*segment])
+			copy(b[ENC_HEADER_SIZE+segment:], first)
+			return b
+		}, ad, keys},
+		{"extra segment", func(b []byte) []byte { return append(b, b[ENC_HEADER_SIZE:ENC_HEADER_SIZE+segment]...) }, ad, keys},
+		{"other blob", func(b []byte) []byte { return b }, []byte("SHA3-512:def"), keys},
+		{"wrong key", func(b []byte) []byte { return b }, ad, VolKeys{Blob: bytes.Repeat([]byte{8}, 32)}},
+		{"bad magic", func(b []byte) []byte { b[0] = 'X'; return b }, ad, keys},
+	}
+	for _, c := range cases {
+		tampered := c.tamper(append([]byte{}, enc...))
+		if dec, err := decrypt_bytes(c.keys, tampered, c.ad); err == nil {
+			t.Errorf("%s: decrypted %d bytes without error", c.name, len(dec))
+		}
+	}
+}
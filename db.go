@@ -1,3 +1,10 @@
 package main
 
-const CREATE_DB_SQL = "BEGIN TRANSACTION;\nCREATE TABLE IF NOT EXISTS `volumes` (\n\t`uuid`\tTEXT NOT NULL,\n\t`name`\tTEXT NOT NULL,\n\t`desc`\tTEXT NOT NULL,\n\tPRIMARY KEY(`uuid`)\n);\nCREATE TABLE IF NOT EXISTS `inodes` (\n\t`uuid`\tTEXT NOT NULL,\n\t`type`\tTEXT NOT NULL,\n\t`hash`\tTEXT NOT NULL,\n\t`compression`\tTEXT NOT NULL,\n\t`original_path`\tTEXT NOT NULL,\n\t`target_path`\tTEXT NOT NULL,\n\t`size`\tINTEGER NOT NULL,\n\t`user`\tTEXT NOT NULL,\n\t`group`\tTEXT NOT NULL,\n\t`mode`\tTEXT NOT NULL,\n\t`mod_time`\tINTEGER NOT NULL,\n\t`scan_time`\tINTEGER NOT NULL,\n\tPRIMARY KEY(`uuid`)\n);\nCREATE TABLE IF NOT EXISTS `blobs` (\n\t`hash`\tTEXT NOT NULL,\n\t`size`\tINTEGER NOT NULL,\n\t`volume_uuid`\tTEXT NOT NULL,\n\t`first_added`	INTEGER NOT NULL,\n\tPRIMARY KEY(`hash`)\n);\nCREATE INDEX IF NOT EXISTS `idx_inodes_user` ON `inodes` (\n\t`user`\tASC\n);\nCREATE INDEX IF NOT EXISTS `idx_inodes_type` ON `inodes` (\n\t`type`\tASC\n);\nCREATE INDEX IF NOT EXISTS `idx_inodes_target_path` ON `inodes` (\n\t`target_path`\tASC\n);\nCREATE INDEX IF NOT EXISTS `idx_inodes_size` ON `inodes` (\n\t`size`\tASC\n);\nCREATE INDEX IF NOT EXISTS `idx_inodes_original_path` ON `inodes` (\n\t`original_path`\tASC\n);\nCREATE INDEX IF NOT EXISTS `idx_inodes_scan_time` ON `inodes` (\n\t`scan_time`\tASC\n);\nCREATE INDEX IF NOT EXISTS `idx_inodes_hash` ON `inodes` (\n\t`hash`\tASC\n);\nCREATE INDEX IF NOT EXISTS `idx_inodes_group` ON `inodes` (\n\t`group`\tASC\n);\nCOMMIT;"
+import (
+	_ "embed"
+)
+
+// Schema of new databases (older ones are brought up to date by Migrations first)
+//
+//go:embed model.sql
+var CREATE_DB_SQL string
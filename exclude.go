@@ -0,0 +1,222 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// Per directory file with gitignore-style patterns
+const BLUIGNORE_FILE = ".bluignore"
+
+var FlagExclude []string
+var FlagExcludeFrom []string
+var FlagInclude []string
+var FlagDryRun bool
+
+// Rules given on the command line (.bluignore rules are loaded while scanning and kept apart)
+var BackupExcludes []PathRule
+
+// A gitignore-style pattern. As in git, the last rule that matches a path wins.
+type PathRule struct {
+	Pattern string // As written by the user
+	Source  string // Where the rule came from
+	Base    string // Folder the pattern is relative to
+	Negate  bool   // Patterns starting with ! include what previous rules excluded
+	DirOnly bool   // Patterns ending with / only match folders
+	Regexp  *regexp.Regexp
+	// Patterns without a slash match the name at any depth, others match the path relative to Base
+	Anchored bool
+}
+
+func (rule PathRule) String() string {
+	return fmt.Sprintf("'%s' from %s", rule.Pattern, rule.Source)
+}
+
+// Parses a single pattern, returns nil for blank lines and comments
+func NewPathRule(pattern, base, source string) (*PathRule, error) {
+	rule := &PathRule{Pattern: pattern, Source: source, Base: base}
+	pat := strings.TrimRight(pattern, " \t\r")
+	if pat == "" || strings.HasPrefix(pat, "#") {
+		return nil, nil
+	}
+	if strings.HasPrefix(pat, "!") {
+		rule.Negate = true
+		pat = pat[1:]
+	} else if strings.HasPrefix(pat, `\!`) || strings.HasPrefix(pat, `\#`) {
+		pat = pat[1:]
+	}
+	// Allow absolute paths inside the folder being backed up
+	if filepath.IsAbs(pat) && strings.HasPrefix(pat, base+"/") {
+		pat = strings.TrimPrefix(pat, base)
+	}
+	if strings.HasSuffix(pat, "/") {
+		rule.DirOnly = true
+		pat = strings.TrimRight(pat, "/")
+	}
+	if pat == "" {
+		return nil, errors.New("empty pattern: " + pattern)
+	}
+	rule.Anchored = strings.Contains(pat, "/")
+	pat = strings.TrimPrefix(pat, "/")
+	re, err := regexp.Compile("^" + glob_to_regexp(pat) + "$")
+	if err != nil {
+		return nil, fmt.Errorf("invalid pattern '%s': %s", pattern, err)
+	}
+	rule.Regexp = re
+	return rule, nil
+}
+
+// Converts a gitignore glob (with *, ?, [...] and **) into a regular expression
+func glob_to_regexp(glob string) string {
+	re := strings.Builder{}
+	for i := 0; i < len(glob); i++ {
+		c := glob[i]
+		switch {
+		case strings.HasPrefix(glob[i:], "**/"):
+			re.WriteString("(.*/)?")
+			i += 2
+		case strings.HasPrefix(glob[i:], "/**") && i+3 == len(glob):
+			re.WriteString("/.*")
+			i += 2
+		case strings.HasPrefix(glob[i:], "**"):
+			re.WriteString(".*")
+			i++
+		case c == '*':
+			re.WriteString("[^/]*")
+		case c == '?':
+			re.WriteString("[^/]")
+		case c == '\\' && i+1 < len(glob):
+			i++
+			re.WriteString(regexp.QuoteMeta(string(glob[i])))
+		case c == '[':
+			end := strings.IndexByte(glob[i+1:], ']')
+			if end < 0 {
+				re.WriteString(`\[`)
+				continue
+			}
+			class := glob[i+1 : i+1+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			re.WriteString("[" + strings.Replace(class, `\`, `\\`, -1) + "]")
+			i += end + 1
+		default:
+			re.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	return re.String()
+}
+
+func (rule PathRule) Match(path string, is_dir bool) bool {
+	if rule.DirOnly && !is_dir {
+		return false
+	}
+	if !strings.HasPrefix(path, rule.Base+"/") {
+		return false
+	}
+	rel := strings.TrimPrefix(path, rule.Base+"/")
+	if !rule.Anchored {
+		rel = filepath.Base(rel)
+	}
+	return rule.Regexp.MatchString(rel)
+}
+
+// Returns the last rule that matches the path (nil if no rule does or if it is a negated one)
+func MatchRules(rules []PathRule, path string, is_dir bool) *PathRule {
+	rule := last_matching_rule(rules, path, is_dir)
+	if rule == nil || rule.Negate {
+		return nil
+	}
+	return rule
+}
+
+// Like MatchRules, but the command line rules (BackupExcludes) come after the .bluignore rules, so --include and --exclude always win over them
+func MatchBackupRules(bluignore []PathRule, path string, is_dir bool) *PathRule {
+	rule := last_matching_rule(BackupExcludes, path, is_dir)
+	if rule == nil {
+		rule = last_matching_rule(bluignore, path, is_dir)
+	}
+	if rule == nil || rule.Negate {
+		return nil
+	}
+	return rule
+}
+
+func last_matching_rule(rules []PathRule, path string, is_dir bool) *PathRule {
+	for i := len(rules) - 1; i >= 0; i-- {
+		if rules[i].Match(path, is_dir) {
+			return &rules[i]
+		}
+	}
+	return nil
+}
+
+// Reads a file with one pattern per line
+func LoadRuleFile(path, base string) ([]PathRule, error) {
+	fptr, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer fptr.Close()
+	rules := make([]PathRule, 0)
+	scanner := bufio.NewScanner(fptr)
+	for n_line := 1; scanner.Scan(); n_line++ {
+		rule, err := NewPathRule(scanner.Text(), base, fmt.Sprintf("%s:%d", path, n_line))
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %s", path, n_line, err)
+		}
+		if rule != nil {
+			rules = append(rules, *rule)
+		}
+	}
+	return rules, scanner.Err()
+}
+
+// Builds the rules given on the command line (includes come last, so they win over excludes, and all of them win over .bluignore files)
+func LoadBackupExcludes(root string) ([]PathRule, error) {
+	rules := make([]PathRule, 0)
+	for _, path := range FlagExcludeFrom {
+		file_rules, err := LoadRuleFile(path, root)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, file_rules...)
+	}
+	add := func(pattern, source string) error {
+		rule, err := NewPathRule(pattern, root, source)
+		if rule != nil {
+			rules = append(rules, *rule)
+		}
+		return err
+	}
+	for _, pattern := range FlagExclude {
+		if err := add(pattern, "--exclude"); err != nil {
+			return nil, err
+		}
+	}
+	for _, pattern := range FlagInclude {
+		if err := add("!"+strings.TrimPrefix(pattern, "!"), "--include"); err != nil {
+			return nil, err
+		}
+	}
+	return rules, nil
+}
+
+// Adds the rules of the .bluignore file in dir (if any) to the ones inherited from its parents (deeper files win)
+func load_bluignore(dir string, inherited []PathRule) []PathRule {
+	path := filepath.Join(dir, BLUIGNORE_FILE)
+	rules, err := LoadRuleFile(path, dir)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			Log.WarningF("Failed to read '%s': %s", path, err)
+		}
+		return inherited
+	}
+	// Do not let sibling folders share (and overwrite) the same backing array
+	return append(inherited[:len(inherited):len(inherited)], rules...)
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"regexp"
+	"testing"
+)
+
+func TestGlobToRegexp(t *testing.T) {
+	cases := []struct {
+		glob  string
+		path  string
+		match bool
+	}{
+		{"*.log", "a.log", true},
+		{"*.log", "dir/a.log", false},
+		{"a?c", "abc", true},
+		{"a?c", "a/c", false},
+		{"**/build", "build", true},
+		{"**/build", "x/y/build", true},
+		{"logs/**", "logs/a/b", true},
+		{"logs/**", "logs", false},
+		{"a/**/b", "a/b", true},
+		{"a/**/b", "a/x/y/b", true},
+		{"[abc].txt", "b.txt", true},
+		{"[!abc].txt", "b.txt", false},
+		{"[!abc].txt", "d.txt", true},
+		{`\*.txt`, "*.txt", true},
+		{`\*.txt`, "a.txt", false},
+		{"a+b(c).txt", "a+b(c).txt", true},
+		{"[unclosed", "[unclosed", true},
+	}
+	for _, c := range cases {
+		re := regexp.MustCompile("^" + glob_to_regexp(c.glob) + "$")
+		if re.MatchString(c.path) != c.match {
+			t.Errorf("glob %q on %q: expected match = %v (regexp %s)", c.glob, c.path, c.match, re)
+		}
+	}
+}
+
+func must_rules(t *testing.T, base, source string, patterns ...string) []PathRule {
+	rules := make([]PathRule, 0)
+	for _, pattern := range patterns {
+		rule, err := NewPathRule(pattern, base, source)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rule != nil {
+			rules = append(rules, *rule)
+		}
+	}
+	return rules
+}
+
+func TestMatchRules(t *testing.T) {
+	rules := must_rules(t, "/src", "test", "# comment", "*.log", "!keep.log", "build/", "/top.txt", "docs/*.tmp")
+	cases := []struct {
+		path     string
+		is_dir   bool
+		excluded bool
+	}{
+		{"/src/a.log", false, true},
+		{"/src/deep/a.log", false, true},
+		{"/src/keep.log", false, false},
+		{"/src/deep/keep.log", false, false},
+		{"/src/build", true, true},
+		{"/src/build", false, false},
+		{"/src/x/build", true, true},
+		{"/src/top.txt", false, true},
+		{"/src/x/top.txt", false, false},
+		{"/src/docs/a.tmp", false, true},
+		{"/src/x/docs/a.tmp", false, false},
+		{"/other/a.log", false, false},
+	}
+	for _, c := range cases {
+		if excluded := MatchRules(rules, c.path, c.is_dir) != nil; excluded != c.excluded {
+			t.Errorf("%s (dir = %v): expected excluded = %v", c.path, c.is_dir, c.excluded)
+		}
+	}
+}
+
+// Command line rules win over .bluignore rules, whatever their order
+func TestMatchBackupRules(t *testing.T) {
+	old := BackupExcludes
+	defer func() { BackupExcludes = old }()
+	bluignore := must_rules(t, "/src", "/src/.bluignore", "*.log", "!*.txt")
+	BackupExcludes = append(must_rules(t, "/src", "--exclude", "*.txt"), must_rules(t, "/src", "--include", "!keep.log")...)
+	cases := []struct {
+		path     string
+		excluded bool
+	}{
+		{"/src/a.log", true},
+		{"/src/keep.log", false},
+		{"/src/a.txt", true},
+		{"/src/a.md", false},
+	}
+	for _, c := range cases {
+		if excluded := MatchBackupRules(bluignore, c.path, false) != nil; excluded != c.excluded {
+			t.Errorf("%s: expected excluded = %v", c.path, c.excluded)
+		}
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sync"
+)
+
+// Paths of a regular file with many hard links share the hash of the first one scanned (the leader), whose UUID names the link group
+type hard_link_group struct {
+	done   chan struct{}
+	leader INode
+}
+
+var HardLinks map[string]*hard_link_group = make(map[string]*hard_link_group)
+var HardLinksLock sync.Mutex
+var HardLinksCount int64
+
+// Returns the group of the inode and whether the caller is its leader (i.e. the first to ask)
+func join_hard_link_group(device, inode_num uint64) (*hard_link_group, bool) {
+	key := fmt.Sprintf("%d:%d", device, inode_num)
+	HardLinksLock.Lock()
+	defer HardLinksLock.Unlock()
+	group, ok := HardLinks[key]
+	if ok {
+		return group, false
+	}
+	group = &hard_link_group{done: make(chan struct{})}
+	HardLinks[key] = group
+	return group, true
+}
+
+// Called by the leader once it was scanned (even if it failed, so the other links do not wait forever)
+func (group *hard_link_group) finish(leader *INode) {
+	group.leader = *leader
+	close(group.done)
+}
+
+func (group *hard_link_group) wait() INode {
+	<-group.done
+	return group.leader
+}
+
+// Links dest to a file restored before (falling back to a copy if the filesystem can't do it)
+func restore_hard_link(node INode, first, dest string) error {
+	if _, err := os.Lstat(dest); err == nil {
+		os.Remove(dest)
+	}
+	err := os.Link(first, dest)
+	if err != nil {
+		Log.WarningF("Failed to hard link '%s' to '%s' (restoring a copy instead): %s", dest, first, err)
+		return restore_file(node, dest)
+	}
+	return nil
+}
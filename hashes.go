@@ -0,0 +1,112 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"strings"
+
+	"github.com/zeebo/blake3"
+	"golang.org/x/crypto/sha3"
+)
+
+// Hashes are stored as "algorithm:hex digest", so blobs made with different algorithms never mix
+const HASH_SHA3_512 = "SHA3-512"
+const HASH_SHA256 = "SHA-256"
+const HASH_BLAKE3 = "BLAKE3"
+
+var HashAlgorithms map[string]func() hash.Hash = map[string]func() hash.Hash{
+	HASH_SHA3_512: sha3.New512,
+	HASH_SHA256:   sha256.New,
+	HASH_BLAKE3:   func() hash.Hash { return blake3.New() },
+}
+
+// Algorithm used for new hashes (it is set per database)
+var HashAlgorithm string = HASH_SHA3_512
+var FlagHash string
+var FlagBackupHash string
+
+// Converts the name given by the user into an algorithm name
+func ParseHashAlgorithm(name string) (string, error) {
+	switch strings.ToUpper(strings.Replace(name, "-", "", -1)) {
+	case "SHA3512", "SHA3":
+		return HASH_SHA3_512, nil
+	case "SHA256":
+		return HASH_SHA256, nil
+	case "BLAKE3":
+		return HASH_BLAKE3, nil
+	}
+	return "", errors.New("unknown hash algorithm: " + name)
+}
+
+// Extracts the algorithm from a hash like "SHA3-512:4f2a..."
+func hash_algorithm_of(hash string) string {
+	return strings.SplitN(hash, ":", 2)[0]
+}
+
+func new_hasher() hash.Hash {
+	return HashAlgorithms[HashAlgorithm]()
+}
+
+func format_hash(hasher hash.Hash) string {
+	return format_hash_as(HashAlgorithm, hasher)
+}
+
+func format_hash_as(alg string, hasher hash.Hash) string {
+	return alg + ":" + hex.EncodeToString(hasher.Sum(nil))
+}
+
+func hash_reader(in io.Reader) (string, int64, error) {
+	return hash_reader_as(HashAlgorithm, in)
+}
+
+// Hashes in with the same algorithm used for other_hash (for checking old blobs no matter what the database uses now)
+func hash_reader_like(other_hash string, in io.Reader) (string, int64, error) {
+	return hash_reader_as(hash_algorithm_of(other_hash), in)
+}
+
+func hash_reader_as(alg string, in io.Reader) (string, int64, error) {
+	new_func, ok := HashAlgorithms[alg]
+	if !ok {
+		return "", 0, errors.New("unknown hash algorithm: " + alg)
+	}
+	hasher := new_func()
+	size_hashed, err := io.Copy(hasher, in)
+	if err != nil {
+		return "", 0, err
+	}
+	return format_hash_as(alg, hasher), size_hashed, nil
+}
+
+// Databases without this setting were made before other algorithms existed, so they use SHA3-512
+func LoadHashAlgorithm() error {
+	alg, err := GetSetting(SETTING_HASH_ALGORITHM, HASH_SHA3_512)
+	if err != nil {
+		return err
+	}
+	if _, ok := HashAlgorithms[alg]; !ok {
+		return errors.New("unknown hash algorithm: " + alg)
+	}
+	HashAlgorithm = alg
+	return nil
+}
+
+// Changing the algorithm of a database with blobs would make every file look new, so it is only allowed before the first backup
+func SetHashAlgorithm(alg string) error {
+	if alg == HashAlgorithm {
+		return SetSetting(SETTING_HASH_ALGORITHM, alg)
+	}
+	var n_blobs int64
+	err := DB.QueryRow("SELECT COUNT(*) FROM `blobs`;").Scan(&n_blobs)
+	if err != nil {
+		return err
+	}
+	if n_blobs > 0 {
+		return fmt.Errorf("database already has %d blobs hashed with %s", n_blobs, HashAlgorithm)
+	}
+	HashAlgorithm = alg
+	return SetSetting(SETTING_HASH_ALGORITHM, alg)
+}
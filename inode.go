@@ -2,41 +2,173 @@ package main
 
 import (
 	"errors"
-	"fmt"
-	"io/ioutil"
+	"io"
 	"os"
-	"os/user"
 	"path/filepath"
+	"strings"
+	"sync/atomic"
 	"syscall"
 	"time"
 
-	"github.com/mholt/archiver"
-
 	"github.com/gjvnq/go.uuid"
 )
 
 const INODE_TYPE_FILE = "f"
 const INODE_TYPE_DIRECTORY = "d"
 const INODE_TYPE_SYMBOLIC_LINK = "l"
+const INODE_TYPE_FIFO = "p"
+const INODE_TYPE_CHAR_DEVICE = "c"
+const INODE_TYPE_BLOCK_DEVICE = "b"
 
 type INode struct {
-	UUID         string    `json:uuid`
-	Type         string    `json:type`
-	Hash         string    `json:hash` // If it is a link, this will be null
-	Compression  string    `json:compression`
-	OriginalPath string    `json:original_path`
-	HackPath     string    `json:-`
-	TargetPath   string    `json:target_path` // Used only for links
-	Size         int64     `json:size`        // In bytes
-	User         string    `json:user`
-	Group        string    `json:group`
-	Mode         string    `json:mode`
-	ModTime      time.Time `json:mod_time`
-	ScanTime     time.Time `json:scan_time`
+	UUID         string          `json:uuid`
+	Type         string          `json:type`
+	Hash         string          `json:hash` // If it is a link, this will be null
+	Compression  string          `json:compression`
+	OriginalPath string          `json:original_path`
+	HackPath     string          `json:-`
+	HackData     []byte          `json:-`           // Only for packed folders archived in memory
+	Chunks       []Chunk         `json:-`           // Only for chunked files that were just hashed
+	Members      []ArchiveMember `json:-`           // Only for packed folders that were just archived
+	XAttrs       []XAttr         `json:-`           // Only for inodes that were just scanned
+	TargetPath   string          `json:target_path` // Used only for links
+	Size         int64           `json:size`        // In bytes
+	User         string          `json:user`        // Empty if the uid had no name
+	Group        string          `json:group`       // Empty if the gid had no name
+	UID          int64           `json:uid`         // -1 for inodes saved before ids were stored
+	GID          int64           `json:gid`
+	Mode         uint32          `json:mode` // st_mode bits (type, permissions, setuid, setgid and sticky)
+	ModTime      time.Time       `json:mod_time`
+	ScanTime     time.Time       `json:scan_time`
+	SnapshotID   int64           `json:snapshot_id`
+	ChangeTime   time.Time       `json:change_time`
+	INodeNum     uint64          `json:inode_num`
+	Device       uint64          `json:device`
+	NLink        uint64          `json:nlink`
+	LinkGroup    string          `json:link_group` // UUID of the first inode scanned among the hard links of the same file
+	AccessTime   time.Time       `json:access_time`
+	BirthTime    time.Time       `json:birth_time` // Unix epoch if the filesystem does not know it
+	DevMajor     uint32          `json:dev_major`  // Used only for devices
+	DevMinor     uint32          `json:dev_minor`
 }
 
 const ERR_INVALID_INODE_TYPE = "invalid inode type (ex: sockets)"
 
+// Inodes with no content of their own
+func is_special_type(inode_type string) bool {
+	return inode_type == INODE_TYPE_FIFO || inode_type == INODE_TYPE_CHAR_DEVICE || inode_type == INODE_TYPE_BLOCK_DEVICE
+}
+
+// Columns in the same order ScanINode expects them
+const INODE_COLUMNS = "`uuid`, `type`, `hash`, `compression`, `original_path`, `target_path`, `size`, `user`, `group`, `mode`, `mod_time`, `scan_time`, `snapshot_id`, `change_time`, `inode_num`, `device`, `nlink`, `link_group`, `uid`, `gid`, `mod_time_nsec`, `change_time_nsec`, `access_time`, `access_time_nsec`, `birth_time`, `birth_time_nsec`, `dev_major`, `dev_minor`"
+
+// Anything that looks like *sql.Row or *sql.Rows
+type RowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func ScanINode(row RowScanner) (INode, error) {
+	node := INode{}
+	var mod_time, scan_time, change_time, access_time, birth_time int64
+	var mod_time_nsec, change_time_nsec, access_time_nsec, birth_time_nsec int64
+	err := row.Scan(&node.UUID, &node.Type, &node.Hash, &node.Compression, &node.OriginalPath, &node.TargetPath, &node.Size, &node.User, &node.Group, &node.Mode, &mod_time, &scan_time, &node.SnapshotID, &change_time, &node.INodeNum, &node.Device, &node.NLink, &node.LinkGroup, &node.UID, &node.GID, &mod_time_nsec, &change_time_nsec, &access_time, &access_time_nsec, &birth_time, &birth_time_nsec, &node.DevMajor, &node.DevMinor)
+	node.ModTime = time.Unix(mod_time, mod_time_nsec)
+	node.ScanTime = time.Unix(scan_time, 0)
+	node.ChangeTime = time.Unix(change_time, change_time_nsec)
+	node.AccessTime = time.Unix(access_time, access_time_nsec)
+	node.BirthTime = time.Unix(birth_time, birth_time_nsec)
+	return node, err
+}
+
+// Does the opposite of os.FileMode.String()
+func ParseModeStr(str string) (os.FileMode, error) {
+	const type_chars = "dalTLDpSugct?"
+	var mode os.FileMode
+	if len(str) < 10 {
+		return 0, errors.New("mode string is too short: " + str)
+	}
+	flags := str[:len(str)-9]
+	perms := str[len(str)-9:]
+	if flags != "-" {
+		for _, c := range flags {
+			i := strings.IndexRune(type_chars, c)
+			if i < 0 {
+				return 0, errors.New("invalid mode string: " + str)
+			}
+			mode |= 1 << uint(32-1-i)
+		}
+	}
+	const rwx = "rwxrwxrwx"
+	for i, c := range perms {
+		if byte(c) == rwx[i] {
+			mode |= 1 << uint(9-1-i)
+		} else if c != '-' {
+			return 0, errors.New("invalid mode string: " + str)
+		}
+	}
+	return mode, nil
+}
+
+// Converts os.FileMode into st_mode bits, as in stat(2)
+func FileModeToStatMode(mode os.FileMode) uint32 {
+	st_mode := uint32(mode.Perm())
+	switch {
+	case mode&os.ModeDir != 0:
+		st_mode |= syscall.S_IFDIR
+	case mode&os.ModeSymlink != 0:
+		st_mode |= syscall.S_IFLNK
+	case mode&os.ModeNamedPipe != 0:
+		st_mode |= syscall.S_IFIFO
+	case mode&os.ModeSocket != 0:
+		st_mode |= syscall.S_IFSOCK
+	case mode&os.ModeCharDevice != 0:
+		st_mode |= syscall.S_IFCHR
+	case mode&os.ModeDevice != 0:
+		st_mode |= syscall.S_IFBLK
+	default:
+		st_mode |= syscall.S_IFREG
+	}
+	if mode&os.ModeSetuid != 0 {
+		st_mode |= syscall.S_ISUID
+	}
+	if mode&os.ModeSetgid != 0 {
+		st_mode |= syscall.S_ISGID
+	}
+	if mode&os.ModeSticky != 0 {
+		st_mode |= syscall.S_ISVTX
+	}
+	return st_mode
+}
+
+// Does the opposite of FileModeToStatMode
+func StatModeToFileMode(st_mode uint32) os.FileMode {
+	mode := os.FileMode(st_mode & 0777)
+	switch st_mode & syscall.S_IFMT {
+	case syscall.S_IFDIR:
+		mode |= os.ModeDir
+	case syscall.S_IFLNK:
+		mode |= os.ModeSymlink
+	case syscall.S_IFIFO:
+		mode |= os.ModeNamedPipe
+	case syscall.S_IFSOCK:
+		mode |= os.ModeSocket
+	case syscall.S_IFCHR:
+		mode |= os.ModeDevice | os.ModeCharDevice
+	case syscall.S_IFBLK:
+		mode |= os.ModeDevice
+	}
+	if st_mode&syscall.S_ISUID != 0 {
+		mode |= os.ModeSetuid
+	}
+	if st_mode&syscall.S_ISGID != 0 {
+		mode |= os.ModeSetgid
+	}
+	if st_mode&syscall.S_ISVTX != 0 {
+		mode |= os.ModeSticky
+	}
+	return mode
+}
+
 func NewINodeFromFile(path string) (*INode, error) {
 	node := &INode{}
 	err := node.FromFile(path)
@@ -44,12 +176,84 @@ func NewINodeFromFile(path string) (*INode, error) {
 	return node, err
 }
 
-func (inode INode) Save() error {
-	_, err := DB.Exec("INSERT INTO `inodes` (`uuid`, `type`, `hash`, `compression`, `original_path`, `target_path`, `size`, `user`, `group`, `mode`, `mod_time`, `scan_time`) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?);", inode.UUID, inode.Type, inode.Hash, inode.Compression, inode.OriginalPath, inode.TargetPath, inode.Size, inode.User, inode.Group, inode.Mode, inode.ModTime.Unix(), inode.ScanTime.Unix())
+func (inode INode) Save(q Querier) error {
+	_, err := q.Exec("INSERT INTO `inodes` (`uuid`, `type`, `hash`, `compression`, `original_path`, `target_path`, `size`, `user`, `group`, `mode`, `mod_time`, `scan_time`, `snapshot_id`, `change_time`, `inode_num`, `device`, `nlink`, `link_group`, `uid`, `gid`, `mod_time_nsec`, `change_time_nsec`, `access_time`, `access_time_nsec`, `birth_time`, `birth_time_nsec`, `dev_major`, `dev_minor`) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?);", inode.UUID, inode.Type, inode.Hash, inode.Compression, inode.OriginalPath, inode.TargetPath, inode.Size, inode.User, inode.Group, inode.Mode, inode.ModTime.Unix(), inode.ScanTime.Unix(), inode.SnapshotID, inode.ChangeTime.Unix(), inode.INodeNum, inode.Device, inode.NLink, inode.LinkGroup, inode.UID, inode.GID, inode.ModTime.Nanosecond(), inode.ChangeTime.Nanosecond(), unix_or_zero(inode.AccessTime), inode.AccessTime.Nanosecond(), unix_or_zero(inode.BirthTime), inode.BirthTime.Nanosecond(), inode.DevMajor, inode.DevMinor)
 	if err != nil {
 		Log.Warning(err)
+		return err
+	}
+	return SaveXAttrs(q, inode.UUID, inode.XAttrs)
+}
+
+// The zero time.Time is not the Unix epoch
+func unix_or_zero(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
 	}
-	return err
+	return t.Unix()
+}
+
+// Returns the most recent inode of a regular file saved with the given path (by a backup that finished)
+func LoadPreviousINode(path string) (INode, error) {
+	node, err := ScanINode(DB.QueryRow("SELECT "+INODE_COLUMNS+" FROM `inodes` WHERE `original_path` = ? AND `type` = ? AND "+complete_snapshot_cond("inodes")+" ORDER BY `scan_time` DESC LIMIT 1;", path, INODE_TYPE_FILE))
+	if err != nil {
+		if err.Error() == "sql: no rows in result set" {
+			err = nil
+		} else {
+			Log.Warning(err)
+		}
+	}
+	return node, err
+}
+
+// Tells whether the file seems to be the same one saved in a previous inode, i.e. its hash can be reused
+func (node INode) SameFileAs(prev INode) bool {
+	return prev.Hash != "" &&
+		prev.Type == node.Type &&
+		prev.Size == node.Size &&
+		prev.INodeNum == node.INodeNum &&
+		(prev.Device == 0 || prev.Device == node.Device) &&
+		same_time(prev.ModTime, node.ModTime) &&
+		same_time(prev.ChangeTime, node.ChangeTime)
+}
+
+// Inodes saved before nanoseconds were stored can only be compared up to the second
+func same_time(prev, now time.Time) bool {
+	if prev.Nanosecond() == 0 {
+		return prev.Unix() == now.Unix()
+	}
+	return prev.Equal(now)
+}
+
+// Archives the folder (in memory or on the staging area), hashing the archive while it is written
+func (node *INode) pack_folder() error {
+	out := &spill_writer{prefix: "tmp_tar_"}
+	// Specify compression method
+	node.Compression = PackDirFormat
+	// Actually compress file
+	hasher := new_hasher()
+	counter := &counting_writer{out: io.MultiWriter(out, hasher)}
+	var err error
+	node.Members, err = write_archive(counter, PackDirFormat, node.OriginalPath)
+	path, data, close_err := out.Close()
+	if err == nil {
+		err = close_err
+	}
+	if err != nil {
+		Log.WarningF("FromFile(path = '%s') (write_archive): %s ", node.OriginalPath, err)
+		unstage(path, data)
+		return err
+	}
+	node.HackPath, node.HackData = path, data
+	if data != nil {
+		// Only used on messages (and to choose the codec)
+		node.HackPath = node.OriginalPath
+	}
+	node.Size = counter.n
+	node.Hash = format_hash(hasher)
+	atomic.AddInt64(&HashedFilesCount, 1)
+	Log.Debug("Hashed '" + node.OriginalPath + "' = " + node.Hash)
+	return nil
 }
 
 func (node *INode) FromFile(path string) error {
@@ -58,6 +262,9 @@ func (node *INode) FromFile(path string) error {
 	// Generate UUID and set scan time
 	node.UUID = uuid.NewV4().String()
 	node.ScanTime = time.Now()
+	if BackupSnapshot != nil {
+		node.SnapshotID = BackupSnapshot.ID
+	}
 
 	// Get absolute path
 	node.OriginalPath, err = filepath.Abs(path)
@@ -75,51 +282,65 @@ func (node *INode) FromFile(path string) error {
 	node.ModTime = info.ModTime()
 	node.Size = info.Size()
 
-	// Get user and group
+	// Get user, group and other low level stuff
 	if info.Sys() != nil {
-		uid := fmt.Sprintf("%d", info.Sys().(*syscall.Stat_t).Uid)
-		gid := fmt.Sprintf("%d", info.Sys().(*syscall.Stat_t).Gid)
-		u, _ := user.LookupId(uid)
-		g, _ := user.LookupGroupId(gid)
-		node.User = u.Username
-		node.Group = g.Name
+		stat := info.Sys().(*syscall.Stat_t)
+		node.ChangeTime = stat_change_time(stat)
+		node.AccessTime = stat_access_time(stat)
+		node.BirthTime = stat_birth_time(path)
+		node.INodeNum = stat.Ino
+		node.Device = uint64(stat.Dev)
+		node.NLink = uint64(stat.Nlink)
+		node.UID = int64(stat.Uid)
+		node.GID = int64(stat.Gid)
+		node.User, node.Group = lookup_owner_names(stat.Uid, stat.Gid)
+	}
+
+	// Extended attributes (ACLs, SELinux labels, capabilities, etc) are not worth failing the whole file
+	node.XAttrs, err = ReadXAttrs(path)
+	if err != nil {
+		Log.WarningF("FromFile(path = '%s') (ReadXAttrs): %s ", path, err)
 	}
 
 	// Get file mode/type
-	node.Mode = info.Mode().String()
+	node.Mode = FileModeToStatMode(info.Mode())
 	if info.Mode().IsDir() {
 		node.Type = INODE_TYPE_DIRECTORY
 		// Directories have no hash (usually)
 		node.Hash = ""
-		if ContainsStr(SpecialFoldersToPack, info.Name()) {
-			// Get a temporary file
-			fptr, err := ioutil.TempFile(filepath.Dir(node.OriginalPath), "tmp_tar_gz_")
-			path = fptr.Name()
-			fptr.Close()
-			// Specify compression method
-			node.Compression = "tar+gzip"
-			// Actually compress file
-			err = archiver.TarGz.Make(path, []string{node.OriginalPath})
-			if err != nil {
-				Log.WarningF("FromFile(path = '%s') (archiver.TarGz.Make): %s ", path, err)
-				return err
-			}
-			// Remember to delete the file later
-			MarkedForDeletionLock.Lock()
-			MarkedForDeletion = append(MarkedForDeletion, path)
-			MarkedForDeletionLock.Unlock()
-			// Adjust file size
-			info, err := os.Lstat(path)
-			if err != nil {
-				Log.WarningF("FromFile(path = '%s') (os.Lstat): %s ", path, err)
-				return err
-			}
-			node.Size = info.Size()
-		} else {
-			return nil
+		if should_pack_dir(node.OriginalPath) {
+			return node.pack_folder()
 		}
+		return nil
 	} else if info.Mode().IsRegular() {
 		node.Type = INODE_TYPE_FILE
+		// Hard links of the same file are hashed only once
+		if node.NLink > 1 {
+			group, is_leader := join_hard_link_group(node.Device, node.INodeNum)
+			if is_leader {
+				node.LinkGroup = node.UUID
+				defer group.finish(node)
+			} else if leader := group.wait(); leader.Hash != "" && leader.Size == node.Size {
+				node.Hash = leader.Hash
+				node.Chunks = leader.Chunks
+				node.LinkGroup = leader.LinkGroup
+				node.HackPath = path
+				atomic.AddInt64(&HardLinksCount, 1)
+				Log.Debug("Reused hash of hard link '" + node.OriginalPath + "' = " + node.Hash)
+				return nil
+			}
+		}
+		// Skip hashing if nothing changed since the last backup
+		if !FlagRehashAll {
+			prev, err := LoadPreviousINode(node.OriginalPath)
+			if err == nil && node.SameFileAs(prev) {
+				node.Hash = prev.Hash
+				node.HackPath = path
+				atomic.AddInt64(&ReusedHashesCount, 1)
+				Log.Debug("Reused hash of '" + node.OriginalPath + "' = " + node.Hash)
+				return nil
+			}
+		}
 	} else if info.Mode()&os.ModeSymlink != 0 {
 		node.Type = INODE_TYPE_SYMBOLIC_LINK
 		// Links have no hash, but have a Target Path
@@ -130,15 +351,33 @@ func (node *INode) FromFile(path string) error {
 			return err
 		}
 		return nil
+	} else if info.Mode()&os.ModeNamedPipe != 0 || info.Mode()&os.ModeDevice != 0 {
+		// FIFOs and devices have no content, only their type and device numbers
+		node.Type = INODE_TYPE_FIFO
+		if info.Mode()&os.ModeCharDevice != 0 {
+			node.Type = INODE_TYPE_CHAR_DEVICE
+		} else if info.Mode()&os.ModeDevice != 0 {
+			node.Type = INODE_TYPE_BLOCK_DEVICE
+		}
+		node.Hash = ""
+		node.Size = 0
+		if stat, ok := info.Sys().(*syscall.Stat_t); ok && node.Type != INODE_TYPE_FIFO {
+			node.DevMajor, node.DevMinor = device_numbers(uint64(stat.Rdev))
+		}
+		return nil
 	} else {
-		Log.WarningF("FromFile(path = '%s') (invalid inode type, ex: sockets): %s ", path, node.Mode)
+		Log.WarningF("FromFile(path = '%s') (invalid inode type, ex: sockets): %s ", path, info.Mode())
 		return errors.New(ERR_INVALID_INODE_TYPE)
 	}
 
 	// Hash file
 	var size_hashed int64
 	node.HackPath = path
-	node.Hash, size_hashed, err = hash_file(node.HackPath)
+	if node.Type == INODE_TYPE_FILE && should_chunk(node.Size) {
+		node.Hash, size_hashed, node.Chunks, err = hash_and_chunk_file(node.HackPath)
+	} else {
+		node.Hash, size_hashed, err = hash_file(node.HackPath)
+	}
 	if err != nil {
 		return err
 	}
@@ -148,6 +387,7 @@ func (node *INode) FromFile(path string) error {
 	}
 
 	// Store the hash
+	atomic.AddInt64(&HashedFilesCount, 1)
 	Log.Debug("Hashed '" + node.OriginalPath + "' = " + node.Hash)
 
 	return nil
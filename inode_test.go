@@ -0,0 +1,67 @@
+package main
+
+import (
+	"os"
+	"syscall"
+	"testing"
+)
+
+func TestParseModeStr(t *testing.T) {
+	cases := []struct {
+		str  string
+		mode os.FileMode
+		ok   bool
+	}{
+		{"-rw-r--r--", 0644, true},
+		{"-rwxr-xr-x", 0755, true},
+		{"drwxr-xr-x", os.ModeDir | 0755, true},
+		{"Lrwxrwxrwx", os.ModeSymlink | 0777, true},
+		{"ugrwxr-xr-x", os.ModeSetuid | os.ModeSetgid | 0755, true},
+		{"dtrwxrwxrwx", os.ModeDir | os.ModeSticky | 0777, true},
+		{"Dcrw-rw----", os.ModeDevice | os.ModeCharDevice | 0660, true},
+		{"prw-------", os.ModeNamedPipe | 0600, true},
+		{"-rwx", 0, false},
+		{"-rwxr-xr-q", 0, false},
+		{"zrwxr-xr-x", 0, false},
+	}
+	for _, c := range cases {
+		mode, err := ParseModeStr(c.str)
+		if (err == nil) != c.ok {
+			t.Errorf("%q: unexpected error %v", c.str, err)
+			continue
+		}
+		if c.ok && mode != c.mode {
+			t.Errorf("%q: got %v, expected %v", c.str, mode, c.mode)
+		}
+		// Old databases stored mode.String()
+		if c.ok && mode.String() != c.str {
+			t.Errorf("%q: parsed into %v, which prints as %q", c.str, mode, mode.String())
+		}
+	}
+}
+
+func TestStatModeRoundTrip(t *testing.T) {
+	cases := []struct {
+		mode    os.FileMode
+		st_mode uint32
+	}{
+		{0644, syscall.S_IFREG | 0644},
+		{os.ModeDir | 0755, syscall.S_IFDIR | 0755},
+		{os.ModeDir | os.ModeSticky | 0777, syscall.S_IFDIR | syscall.S_ISVTX | 0777},
+		{os.ModeSymlink | 0777, syscall.S_IFLNK | 0777},
+		{os.ModeNamedPipe | 0600, syscall.S_IFIFO | 0600},
+		{os.ModeSocket | 0755, syscall.S_IFSOCK | 0755},
+		{os.ModeDevice | os.ModeCharDevice | 0620, syscall.S_IFCHR | 0620},
+		{os.ModeDevice | 0660, syscall.S_IFBLK | 0660},
+		{os.ModeSetuid | os.ModeSetgid | 0755, syscall.S_IFREG | syscall.S_ISUID | syscall.S_ISGID | 0755},
+	}
+	for _, c := range cases {
+		st_mode := FileModeToStatMode(c.mode)
+		if st_mode != c.st_mode {
+			t.Errorf("%v: got st_mode %o, expected %o", c.mode, st_mode, c.st_mode)
+		}
+		if mode := StatModeToFileMode(st_mode); mode != c.mode {
+			t.Errorf("%o: got %v, expected %v", st_mode, mode, c.mode)
+		}
+	}
+}
@@ -6,9 +6,11 @@ import (
 	"os"
 	"os/signal"
 	"path/filepath"
+	"runtime"
 	"strings"
 	"sync"
 	"syscall"
+	"time"
 
 	"github.com/gjvnq/go-logger"
 	_ "github.com/mattn/go-sqlite3"
@@ -31,6 +33,10 @@ var rootCmd = &cobra.Command{
 	Long:  "A hash based backup tool capable of multiple volumes, links and deduplication. https://github.com/gjvnq/blu-up",
 	PersistentPreRun: func(cmd *cobra.Command, args []string) {
 		Log.Worker.DisabledLevels["DEBUG"] = !FlagDebug
+		err := LoadConfig(cmd)
+		if err != nil {
+			Log.Fatal(err)
+		}
 	},
 }
 
@@ -63,12 +69,58 @@ func backup(cmd *cobra.Command, args []string) {
 	MarkedForDeletionLock = &sync.Mutex{}
 
 	// Set a few variables
+	var err error
+	if FlagBackupHash != "" {
+		alg, err := ParseHashAlgorithm(FlagBackupHash)
+		if err != nil {
+			Log.Fatal(err)
+		}
+		err = SetHashAlgorithm(alg)
+		if err != nil {
+			Log.Fatal(err)
+		}
+	}
+	BackupCodec, err = ParseCodec(FlagCompress)
+	if err != nil {
+		Log.Fatal(err)
+	}
+	ChunkThreshold, err = ParseSize(FlagChunkThreshold)
+	if err != nil {
+		Log.Fatal(err)
+	}
+	if FlagBatchRows < 1 || FlagBatchTime <= 0 {
+		Log.FatalF("--batch-rows and --batch-time must be positive (got %d and %s)", FlagBatchRows, FlagBatchTime)
+	}
 	BackupFromFolder, _ = filepath.Abs(BackupFromFolder)
-	BackupToFolder, _ = filepath.Abs(BackupToFolder)
+	if BackupToFolder != "" {
+		BackupToFolder, _ = filepath.Abs(BackupToFolder)
+	}
 	if BackupToFolder == BackupFromFolder {
 		Log.FatalF("Backup origin ('%s') and destination ('%s') cannot be equal", BackupFromFolder, BackupToFolder)
 		return
 	}
+	BackupExcludes, err = LoadBackupExcludes(BackupFromFolder)
+	if err != nil {
+		Log.Fatal(err)
+	}
+	PackDirRules, err = LoadPackDirRules(BackupFromFolder)
+	if err != nil {
+		Log.Fatal(err)
+	}
+	PackDirFormat, err = ParseArchiveFormat(FlagPackDirFormat)
+	if err != nil {
+		Log.Fatal(err)
+	}
+	if FlagDryRun {
+		inode_scanner_producer(BackupFromFolder, true, nil)
+		return
+	}
+	if BackupVolUUID == "" {
+		BackupVolUUID, err = DiscoverVolUUID(BackupToFolder)
+		if err != nil {
+			Log.Fatal(err)
+		}
+	}
 	vol, err := LoadVol(BackupVolUUID)
 	if err != nil {
 		Log.FatalF("Failed to load volume %s", BackupVolUUID)
@@ -76,18 +128,66 @@ func backup(cmd *cobra.Command, args []string) {
 	if vol.UUID == "" {
 		Log.FatalF("Volume not found %s", BackupVolUUID)
 	}
+	err = vol.Mount(BackupToFolder)
+	if err != nil {
+		Log.FatalF("Failed to mount volume %s: %s", BackupVolUUID, err)
+	}
+	BackupToFolder = vol.Dir
+	if BackupToFolder == BackupFromFolder {
+		Log.FatalF("Backup origin ('%s') and destination ('%s') cannot be equal", BackupFromFolder, BackupToFolder)
+	}
+	err = CreateStagingDir(FlagTmpDir)
+	if err != nil {
+		Log.Fatal(err)
+	}
+	err = vol.SetupPacker()
+	if err != nil {
+		Log.Fatal(err)
+	}
+	bw_limit, err := ParseSize(FlagBwLimit)
+	if err != nil {
+		Log.Fatal(err)
+	}
+	vol.Limiter = NewBwLimiter(bw_limit)
+	BackupVol = vol
 	BackupVolUUID = vol.UUID
 	BackupVolName = vol.Name
+	// Record this run
+	BackupSnapshot = NewSnapshot(BackupFromFolder, BackupVolUUID)
+	err = BackupSnapshot.Save()
+	if err != nil {
+		Log.Fatal(err)
+	}
 	// Start workers
-	go inode_scanner_producer(BackupFromFolder, true)
-	go inode_scanner_consumer()
+	go inode_scanner_producer(BackupFromFolder, true, nil)
+	start_inode_scanners(HashWorkers)
+	SaverBatch = NewSaveBatch(FlagBatchRows, FlagBatchTime)
 	go inode_saver_consumer()
-	go copier_consumer()
+	start_copiers(CopyWorkers)
 	Log.Info("Started backup")
 	<-FinishedSavingCh
-	<-CopierDoneCh
+	err = BackupVol.Packer.Close()
+	if err != nil {
+		Log.Fatal(err)
+	}
 	delete_marked()
-	Log.NoticeF("Finished backup from '%s' to '%s' (volume UUID %s)", BackupFromFolder, BackupToFolder, BackupVolUUID)
+	RemoveStagingDir()
+	// The snapshot is only complete together with the last inodes and blob locations
+	SaverBatch.save_copied()
+	status := SNAPSHOT_STATUS_COMPLETE
+	if SaverBatch.Failed() {
+		Log.Warning("Some inodes could not be saved to the database, so the snapshot is marked as failed")
+		status = SNAPSHOT_STATUS_FAILED
+	}
+	err = BackupSnapshot.Finish(SaverBatch, status)
+	if err == nil {
+		err = SaverBatch.Commit()
+	}
+	if err != nil {
+		Log.Fatal(err)
+	}
+	Log.NoticeF("Hashed %d files and reused the hashes of %d unchanged files and %d hard links", HashedFilesCount, ReusedHashesCount, HardLinksCount)
+	Log.NoticeF("Finished backup from '%s' to '%s' (volume UUID %s, snapshot %d)", BackupFromFolder, BackupToFolder, BackupVolUUID, BackupSnapshot.ID)
 }
 
 var verifyCmd = &cobra.Command{
@@ -107,7 +207,13 @@ func verify(cmd *cobra.Command, args []string) {
 	VerifierWG = &sync.WaitGroup{}
 
 	// Set a few variables
-	BackupToFolder, _ = filepath.Abs(BackupToFolder)
+	var err error
+	if BackupVolUUID == "" {
+		BackupVolUUID, err = DiscoverVolUUID(BackupToFolder)
+		if err != nil {
+			Log.Fatal(err)
+		}
+	}
 	vol, err := LoadVol(BackupVolUUID)
 	if err != nil {
 		Log.FatalF("Failed to load volume %s", BackupVolUUID)
@@ -115,6 +221,12 @@ func verify(cmd *cobra.Command, args []string) {
 	if vol.UUID == "" {
 		Log.FatalF("Volume not found %s", BackupVolUUID)
 	}
+	err = vol.Mount(BackupToFolder)
+	if err != nil {
+		Log.FatalF("Failed to mount volume %s: %s", BackupVolUUID, err)
+	}
+	BackupToFolder = vol.Dir
+	BackupVol = vol
 	BackupVolUUID = vol.UUID
 	BackupVolName = vol.Name
 	// Start workers
@@ -134,6 +246,69 @@ func verify(cmd *cobra.Command, args []string) {
 	Log.Notice("Verification complete")
 }
 
+var restoreCmd = &cobra.Command{
+	Use:   "restore",
+	Short: "Restores files from a volume",
+	Args:  cobra.NoArgs,
+	Run:   restore,
+}
+
+func restore(cmd *cobra.Command, args []string) {
+	// Load DB
+	LoadDB(args)
+	defer DB.Close()
+
+	// Set a few variables
+	if BackupToFolder != "" {
+		BackupToFolder, _ = filepath.Abs(BackupToFolder)
+	}
+	RestoreFromPrefix, _ = filepath.Abs(RestoreFromPrefix)
+	RestoreToFolder, _ = filepath.Abs(RestoreToFolder)
+	var err error
+	RestoreUserMap, err = ParseOwnerMap(FlagMapUser, lookup_uid)
+	if err != nil {
+		Log.Fatal(err)
+	}
+	RestoreGroupMap, err = ParseOwnerMap(FlagMapGroup, lookup_gid)
+	if err != nil {
+		Log.Fatal(err)
+	}
+	if BackupVolUUID == "" {
+		BackupVolUUID, err = DiscoverVolUUID(BackupToFolder)
+		if err != nil {
+			Log.Fatal(err)
+		}
+	}
+	vol, err := LoadVol(BackupVolUUID)
+	if err != nil {
+		Log.FatalF("Failed to load volume %s", BackupVolUUID)
+	}
+	if vol.UUID == "" {
+		Log.FatalF("Volume not found %s", BackupVolUUID)
+	}
+	err = vol.Mount(BackupToFolder)
+	if err != nil {
+		Log.FatalF("Failed to mount volume %s: %s", BackupVolUUID, err)
+	}
+	BackupVol = vol
+	BackupVolUUID = vol.UUID
+	BackupVolName = vol.Name
+	// List what must be restored
+	nodes, err := restore_list_inodes()
+	if err != nil {
+		Log.Fatal(err)
+	}
+	if len(nodes) == 0 {
+		Log.FatalF("No inodes found under '%s'", RestoreFromPrefix)
+	}
+	Log.InfoF("Started restoring %d inodes", len(nodes))
+	n_ok, n_fail := restorer_main(nodes)
+	if n_fail > 0 {
+		Log.ErrorF("Failed to restore %d of %d inodes", n_fail, n_ok+n_fail)
+	}
+	Log.NoticeF("Finished restoring '%s' to '%s' (%d inodes)", RestoreFromPrefix, RestoreToFolder, n_ok)
+}
+
 var initCmd = &cobra.Command{
 	Use:   "init [db path]",
 	Short: "Starts an empty backup database",
@@ -142,12 +317,45 @@ var initCmd = &cobra.Command{
 		// Load DB
 		LoadDB(args)
 		defer DB.Close()
+		// Running init again keeps the algorithm of the database unless --hash is given
+		saved, err := GetSetting(SETTING_HASH_ALGORITHM, "")
+		if err != nil {
+			Log.Fatal(err)
+		}
+		if saved == "" || cmd.Flags().Changed("hash") {
+			alg, err := ParseHashAlgorithm(FlagHash)
+			if err != nil {
+				Log.Fatal(err)
+			}
+			err = SetHashAlgorithm(alg)
+			if err != nil {
+				Log.Fatal(err)
+			}
+		}
+		Log.NoticeF("Database '%s' uses %s hashes", DBPath, HashAlgorithm)
 	},
 }
 
+// Opens the database, brings its schema up to date and loads its settings
 func LoadDB(args []string) {
+	OpenDB(args)
+	err := MigrateDB()
+	if err != nil {
+		Log.Fatal(err)
+	}
+	err = LoadHashAlgorithm()
+	if err != nil {
+		Log.Fatal(err)
+	}
+}
+
+// Opens the database without touching it
+func OpenDB(args []string) {
 	var err error
 	if DBPath == "" {
+		if len(args) == 0 {
+			Log.Fatal("database path not set (use --db)")
+		}
 		DBPath = args[0]
 	}
 	DBPath, err = filepath.Abs(DBPath)
@@ -157,11 +365,12 @@ func LoadDB(args []string) {
 	if !strings.HasSuffix(DBPath, ".sqlite") {
 		Log.Fatal("db path must end with .sqlite")
 	}
-	DB, err = sql.Open("sqlite3", DBPath)
+	synchronous, err := ParseSynchronous(FlagSynchronous)
 	if err != nil {
 		Log.Fatal(err)
 	}
-	_, err = DB.Exec(CREATE_DB_SQL)
+	// WAL lets the hash workers read while the saver writes (and the settings apply to every connection of the pool)
+	DB, err = sql.Open("sqlite3", DBPath+"?_journal_mode=WAL&_synchronous="+synchronous)
 	if err != nil {
 		Log.Fatal(err)
 	}
@@ -177,6 +386,17 @@ func cleanup() {
 
 func BeforeFatal() {
 	delete_marked()
+	RemoveStagingDir()
+	if SaverBatch != nil {
+		SaverBatch.Rollback()
+	}
+	if BackupSnapshot != nil && DB != nil {
+		// Unless its last batch got committed
+		snap, err := LoadSnapshot(BackupSnapshot.ID)
+		if err == nil && snap.Status == SNAPSHOT_STATUS_RUNNING {
+			BackupSnapshot.Finish(DB, SNAPSHOT_STATUS_ABORTED)
+		}
+	}
 }
 
 func main() {
@@ -193,28 +413,104 @@ func main() {
 
 	rootCmd.PersistentFlags().BoolVarP(&FlagDebug, "debug", "", false, "show debug info")
 	rootCmd.PersistentFlags().StringVarP(&DBPath, "db", "", "", "set the database path")
+	rootCmd.PersistentFlags().StringVarP(&FlagSynchronous, "synchronous", "", "normal", "how often SQLite waits for the disk: off, normal (safe with WAL, but the last commits may be lost on power loss), full or extra")
+	rootCmd.PersistentFlags().StringVarP(&FlagConfig, "config", "", "", "config file with default values and backup profiles (default is "+default_config_path()+")")
+	rootCmd.PersistentFlags().StringVarP(&FlagPassphraseFile, "passphrase-file", "", "", "read the passphrase of encrypted volumes from this file (or set BLU_UP_PASSPHRASE)")
 	rootCmd.AddCommand(versionCmd)
+	initCmd.Flags().StringVarP(&FlagHash, "hash", "", HASH_SHA3_512, "hash algorithm for the database: sha3-512, sha-256 or blake3 (it cannot be changed later)")
 	rootCmd.AddCommand(initCmd)
 	volAddCmd.Flags().StringVarP(&FlagUUID, "uuid", "", "", "Force specific UUID for new volume instead of generating a new one")
+	volAddCmd.Flags().BoolVarP(&FlagEncrypt, "encrypt", "e", false, "encrypt the blobs saved on this volume")
+	volAddCmd.Flags().StringVarP(&VolAddFolder, "dir", "d", "", "path to the volume folder, where the volume marker is written (required for encrypted volumes)")
 	volCmd.AddCommand(volAddCmd)
+	volMarkCmd.Flags().StringVarP(&VolAddFolder, "dir", "d", "", "path to the volume folder")
+	volMarkCmd.MarkFlagRequired("dir")
+	volCmd.AddCommand(volMarkCmd)
 	volCmd.AddCommand(volRmCmd)
 	volCmd.AddCommand(volLsCmd)
+	volReplicateCmd.Flags().StringVarP(&ReplicateFromVol, "from-vol", "", "", "volume to copy blobs from (uuid or name)")
+	volReplicateCmd.Flags().StringVarP(&ReplicateFromFolder, "from-dir", "", "", "path to folder with the blobs of the origin volume")
+	volReplicateCmd.Flags().StringVarP(&ReplicateToVol, "to-vol", "", "", "volume to copy blobs to (uuid or name)")
+	volReplicateCmd.Flags().StringVarP(&ReplicateToFolder, "to-dir", "", "", "path to folder with the blobs of the destination volume")
+	volReplicateCmd.Flags().StringVarP(&FlagPackThreshold, "pack-threshold", "", "0", "append blobs smaller than this to pack files on the destination volume (0 disables packing)")
+	volReplicateCmd.Flags().StringVarP(&FlagPackSize, "pack-size", "", "64M", "start a new pack file after this many bytes")
+	volReplicateCmd.MarkFlagRequired("from-vol")
+	volReplicateCmd.MarkFlagRequired("from-dir")
+	volReplicateCmd.MarkFlagRequired("to-vol")
+	volReplicateCmd.MarkFlagRequired("to-dir")
+	volCmd.AddCommand(volReplicateCmd)
 	rootCmd.AddCommand(volCmd)
 	backupCmd.Flags().StringVarP(&BackupFromFolder, "from", "f", "", "path to folder to backup")
-	backupCmd.Flags().StringVarP(&BackupToFolder, "to", "t", "", "path to folder to save blobs")
-	backupCmd.Flags().StringVarP(&BackupVolUUID, "vol", "v", "", "volume uuid or name")
+	backupCmd.Flags().StringVarP(&BackupToFolder, "to", "t", "", "path to folder to save blobs (default is to look for the volume on mounted filesystems)")
+	backupCmd.Flags().StringVarP(&BackupVolUUID, "vol", "v", "", "volume uuid or name (default is the volume whose marker is on the volume folder or on a mounted filesystem)")
+	backupCmd.Flags().BoolVarP(&FlagRehashAll, "rehash-all", "", false, "hash every file even if it seems unchanged since the last backup")
+	backupCmd.Flags().IntVarP(&FlagBatchRows, "batch-rows", "", 1000, "commit the database after this many rows")
+	backupCmd.Flags().DurationVarP(&FlagBatchTime, "batch-time", "", 2*time.Second, "commit the database at least this often")
+	backupCmd.Flags().IntVarP(&HashWorkers, "hash-workers", "", runtime.NumCPU(), "number of files to hash at the same time")
+	backupCmd.Flags().IntVarP(&CopyWorkers, "copy-workers", "", 2, "number of blobs to copy to the volume at the same time")
+	backupCmd.Flags().StringVarP(&FlagBwLimit, "bwlimit", "", "0", "maximum bytes per second read from or written to the volume, like 20M (0 means unlimited)")
+	backupCmd.Flags().StringVarP(&FlagCompress, "compress", "c", "none", "compress new blobs with zstd, gzip or none (already compressed files are never compressed)")
+	backupCmd.Flags().BoolVarP(&FlagChunk, "chunk", "", false, "split big files in content defined chunks, so small changes only store the changed chunks")
+	backupCmd.Flags().StringVarP(&FlagChunkThreshold, "chunk-threshold", "", "64M", "minimum size of files to be chunked")
+	backupCmd.Flags().StringVarP(&FlagPackThreshold, "pack-threshold", "", "0", "append blobs smaller than this to pack files instead of storing each one on its own file (0 disables packing)")
+	backupCmd.Flags().StringVarP(&FlagPackSize, "pack-size", "", "64M", "start a new pack file after this many bytes")
+	backupCmd.Flags().StringArrayVarP(&FlagExclude, "exclude", "x", []string{}, "skip files matching this gitignore-style pattern (can be repeated)")
+	backupCmd.Flags().StringArrayVarP(&FlagExcludeFrom, "exclude-from", "", []string{}, "read exclude patterns from this file (can be repeated)")
+	backupCmd.Flags().StringArrayVarP(&FlagInclude, "include", "", []string{}, "back up files matching this pattern even if an exclude pattern matches them (can be repeated)")
+	backupCmd.Flags().BoolVarP(&FlagDryRun, "dry-run", "n", false, "only list what would be excluded")
+	backupCmd.Flags().StringArrayVarP(&FlagPackDir, "pack-dir", "", []string{}, "store folders matching this gitignore-style pattern as a single archive (.git, .svn and .hg are packed by default)")
+	backupCmd.Flags().StringArrayVarP(&FlagNoPackDir, "no-pack-dir", "", []string{}, "do not pack folders matching this pattern (ex: --no-pack-dir 'big-repo/.git')")
+	backupCmd.Flags().StringArrayVarP(&FlagPackDirsFrom, "pack-dirs-from", "", []string{}, "read patterns of folders to pack from this file (use !pattern to not pack)")
+	backupCmd.Flags().StringVarP(&FlagPackDirFormat, "pack-dir-format", "", ARCHIVE_TAR_GZIP, "archive format for packed folders: tar+gzip or tar+zstd")
+	backupCmd.Flags().StringVarP(&FlagTmpDir, "tmp-dir", "", os.TempDir(), "folder for temporary files, like archives of big packed folders (must not be read only)")
+	backupCmd.Flags().StringVarP(&FlagProfile, "profile", "p", "", "use the values of this profile from the config file for flags not given on the command line")
+	backupCmd.Flags().StringVarP(&FlagBackupHash, "hash", "", "", "hash algorithm for a new database: sha3-512, sha-256 or blake3 (it cannot be changed once the database has blobs)")
 	backupCmd.MarkFlagRequired("db")
 	backupCmd.MarkFlagRequired("from")
-	backupCmd.MarkFlagRequired("to")
-	backupCmd.MarkFlagRequired("vol")
 	rootCmd.AddCommand(backupCmd)
-	verifyCmd.Flags().StringVarP(&BackupToFolder, "to", "t", "", "path to folder to save blobs")
-	verifyCmd.Flags().StringVarP(&BackupVolUUID, "vol", "v", "", "volume uuid or name")
+	verifyCmd.Flags().StringVarP(&BackupToFolder, "to", "t", "", "path to folder to save blobs (default is to look for the volume on mounted filesystems)")
+	verifyCmd.Flags().StringVarP(&BackupVolUUID, "vol", "v", "", "volume uuid or name (default is the volume whose marker is on the volume folder or on a mounted filesystem)")
 	verifyCmd.Flags().BoolVarP(&FlagFix, "fix", "f", false, "attempt to fix wrong or missing blobs")
 	verifyCmd.MarkFlagRequired("db")
-	verifyCmd.MarkFlagRequired("to")
-	verifyCmd.MarkFlagRequired("vol")
 	rootCmd.AddCommand(verifyCmd)
+	restoreCmd.Flags().StringVarP(&BackupToFolder, "vol-dir", "d", "", "path to folder where the blobs are saved (default is to look for the volume on mounted filesystems)")
+	restoreCmd.Flags().StringVarP(&BackupVolUUID, "vol", "v", "", "volume uuid or name (default is the volume whose marker is on the volume folder or on a mounted filesystem)")
+	restoreCmd.Flags().StringVarP(&RestoreFromPrefix, "from-prefix", "f", "", "original path of the folder or file to restore")
+	restoreCmd.Flags().StringVarP(&RestoreToFolder, "to", "t", "", "path where the restored files will be placed (the prefix itself becomes this path)")
+	restoreCmd.Flags().BoolVarP(&FlagNumericOwner, "numeric-owner", "", false, "set owners by the saved uid/gid instead of by user/group names")
+	restoreCmd.Flags().StringArrayVarP(&FlagMapUser, "map-user", "", []string{}, "restore files of a user as another one, ex: alice:1001 or 1000:bob (can be repeated)")
+	restoreCmd.Flags().StringArrayVarP(&FlagMapGroup, "map-group", "", []string{}, "restore files of a group as another one, ex: staff:100 (can be repeated)")
+	restoreCmd.Flags().Int64VarP(&RestoreSnapshotID, "snapshot", "s", 0, "restore the inodes of this snapshot instead of the latest version of each path")
+	restoreCmd.MarkFlagRequired("db")
+	restoreCmd.MarkFlagRequired("from-prefix")
+	restoreCmd.MarkFlagRequired("to")
+	rootCmd.AddCommand(restoreCmd)
+	searchCmd.Flags().StringVarP(&SearchPathGlob, "path", "p", "", "original path matches glob (ex: '/home/*/Photos/*')")
+	searchCmd.Flags().StringVarP(&SearchRegex, "regex", "r", "", "original path matches regular expression")
+	searchCmd.Flags().StringVarP(&SearchName, "name", "n", "", "file name matches glob (ex: '*.jpg')")
+	searchCmd.Flags().StringVarP(&SearchMinSize, "min-size", "", "", "minimum size (ex: 10M)")
+	searchCmd.Flags().StringVarP(&SearchMaxSize, "max-size", "", "", "maximum size (ex: 2G)")
+	searchCmd.Flags().StringVarP(&SearchNewer, "newer", "", "", "modified at or after date (ex: 2018-12-31)")
+	searchCmd.Flags().StringVarP(&SearchOlder, "older", "", "", "modified before date (ex: 2018-12-31)")
+	searchCmd.Flags().StringVarP(&SearchUser, "user", "u", "", "owned by user (name or uid)")
+	searchCmd.Flags().StringVarP(&SearchGroup, "group", "g", "", "owned by group (name or gid)")
+	searchCmd.Flags().StringVarP(&SearchPerm, "perm", "", "", "permission bits in octal, like find: 4755 (exactly), -4000 (all of these) or /6000 (any of these)")
+	searchCmd.Flags().StringVarP(&SearchType, "type", "t", "", "inode type (f, d, l, p for FIFOs, c or b for devices)")
+	searchCmd.Flags().StringVarP(&SearchHash, "hash", "", "", "hash or hash prefix (ex: SHA3-512:4f2a)")
+	searchCmd.Flags().StringVarP(&SearchVol, "vol", "v", "", "blob is on volume (uuid or name)")
+	searchCmd.Flags().Int64VarP(&SearchSnapshotID, "snapshot", "s", 0, "only inodes of this snapshot")
+	searchCmd.Flags().BoolVarP(&FlagSearchArchives, "archives", "", false, "also search files inside packed folders (like .git)")
+	searchCmd.Flags().BoolVarP(&FlagAllVersions, "all-versions", "a", false, "show every saved version of each path")
+	rootCmd.AddCommand(searchCmd)
+	snapshotShowCmd.Flags().BoolVarP(&FlagListINodes, "inodes", "i", false, "also list the inodes in the snapshot")
+	snapshotRmCmd.Flags().BoolVarP(&FlagForceRm, "force", "", false, "also remove snapshots that are still running")
+	snapshotCmd.AddCommand(snapshotLsCmd)
+	snapshotCmd.AddCommand(snapshotShowCmd)
+	snapshotCmd.AddCommand(snapshotRmCmd)
+	rootCmd.AddCommand(snapshotCmd)
+	dbCmd.AddCommand(dbMigrateCmd)
+	dbCmd.AddCommand(dbStatusCmd)
+	rootCmd.AddCommand(dbCmd)
 
 	if err := rootCmd.Execute(); err != nil {
 		fmt.Println(err)
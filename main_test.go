@@ -0,0 +1,35 @@
+package main
+
+import (
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/gjvnq/go-logger"
+)
+
+func TestMain(m *testing.M) {
+	// Most functions log, but tests only care about what they return
+	Log, _ = logger.New("test", 1, ioutil.Discard)
+	os.Exit(m.Run())
+}
+
+func random_bytes(seed int64, n int) []byte {
+	data := make([]byte, n)
+	rand.New(rand.NewSource(seed)).Read(data)
+	return data
+}
+
+// Opens an empty database on a temporary folder (without migrating it)
+func open_test_db(t *testing.T) {
+	DBPath = filepath.Join(t.TempDir(), "test.sqlite")
+	FlagSynchronous = "normal"
+	OpenDB(nil)
+	t.Cleanup(func() {
+		DB.Close()
+		DB = nil
+		DBPath = ""
+	})
+}
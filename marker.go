@@ -0,0 +1,203 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+// Every volume folder has a marker, so blobs are never written to the wrong disk
+const VOLUME_MARKER_FILE = ".blu-up-volume"
+const VOLUME_MARKER_FORMAT = 1
+
+// Filesystems that never hold volumes
+var PseudoFilesystems []string = []string{"autofs", "binfmt_misc", "bpf", "cgroup", "cgroup2", "configfs", "debugfs", "devpts", "devtmpfs", "fusectl", "hugetlbfs", "mqueue", "nsfs", "proc", "pstore", "securityfs", "sysfs", "tracefs"}
+
+type VolumeMarker struct {
+	UUID   string `json:"uuid"`
+	Name   string `json:"name"`
+	Format int    `json:"format"`
+}
+
+func ReadVolumeMarker(dir string) (VolumeMarker, error) {
+	marker := VolumeMarker{}
+	data, err := ioutil.ReadFile(filepath.Join(dir, VOLUME_MARKER_FILE))
+	if err != nil {
+		return marker, err
+	}
+	err = json.Unmarshal(data, &marker)
+	if err != nil {
+		return marker, fmt.Errorf("invalid volume marker on '%s': %s", dir, err)
+	}
+	if marker.Format > VOLUME_MARKER_FORMAT {
+		return marker, fmt.Errorf("volume marker on '%s' has format %d, but this version of blu-up only knows up to %d", dir, marker.Format, VOLUME_MARKER_FORMAT)
+	}
+	return marker, nil
+}
+
+// Creates the marker (it refuses to overwrite the marker of another volume)
+func WriteVolumeMarker(dir string, vol Vol) error {
+	old, err := ReadVolumeMarker(dir)
+	if err == nil && old.UUID != vol.UUID {
+		return fmt.Errorf("folder '%s' already belongs to volume %s (%s)", dir, old.Name, old.UUID)
+	}
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	err = os.MkdirAll(dir, os.ModePerm)
+	if err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(VolumeMarker{UUID: vol.UUID, Name: vol.Name, Format: VOLUME_MARKER_FORMAT}, "", "\t")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(dir, VOLUME_MARKER_FILE), append(data, '\n'), 0644)
+}
+
+// A marker of another volume is always an error. Folders without a marker (like volumes made before markers existed) get one.
+func (vol Vol) CheckMarker() error {
+	marker, err := ReadVolumeMarker(vol.Dir)
+	if os.IsNotExist(err) {
+		Log.WarningF("Folder '%s' has no volume marker, marking it as volume %s (%s)", vol.Dir, vol.Name, vol.UUID)
+		err = WriteVolumeMarker(vol.Dir, vol)
+		if err != nil {
+			// Read only folders can still be verified and restored from
+			Log.WarningF("Failed to write the volume marker on '%s': %s", vol.Dir, err)
+		}
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if marker.UUID != vol.UUID {
+		return fmt.Errorf("folder '%s' holds volume %s (%s), not volume %s (%s)", vol.Dir, marker.Name, marker.UUID, vol.Name, vol.UUID)
+	}
+	return nil
+}
+
+// Lists where filesystems are mounted (from /proc/self/mounts)
+func list_mount_points() ([]string, error) {
+	fptr, err := os.Open("/proc/self/mounts")
+	if err != nil {
+		return nil, err
+	}
+	defer fptr.Close()
+	points := make([]string, 0)
+	scanner := bufio.NewScanner(fptr)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 3 || ContainsStr(PseudoFilesystems, fields[2]) {
+			continue
+		}
+		// Spaces and such are octal escaped
+		point := strings.NewReplacer(`\040`, " ", `\011`, "\t", `\012`, "\n", `\134`, `\`).Replace(fields[1])
+		if !ContainsStr(points, point) {
+			points = append(points, point)
+		}
+	}
+	return points, scanner.Err()
+}
+
+type found_marker struct {
+	Dir    string
+	Marker VolumeMarker
+}
+
+// Reads the volume markers at the root of every mounted filesystem and on the folders right below it
+func find_volume_markers() ([]found_marker, error) {
+	points, err := list_mount_points()
+	if err != nil {
+		return nil, err
+	}
+	found := make([]found_marker, 0)
+	for _, point := range points {
+		candidates := []string{point}
+		children, _ := ioutil.ReadDir(point)
+		for _, child := range children {
+			if child.IsDir() {
+				candidates = append(candidates, filepath.Join(point, child.Name()))
+			}
+		}
+		for _, dir := range candidates {
+			marker, err := ReadVolumeMarker(dir)
+			if err == nil {
+				found = append(found, found_marker{dir, marker})
+			}
+		}
+	}
+	return found, nil
+}
+
+func DiscoverVolumeDir(vol_uuid string) (string, error) {
+	found, err := find_volume_markers()
+	if err != nil {
+		return "", err
+	}
+	for _, f := range found {
+		if f.Marker.UUID == vol_uuid {
+			return f.Dir, nil
+		}
+	}
+	return "", errors.New("volume " + vol_uuid + " is not mounted (no folder with its marker was found)")
+}
+
+// Used when --vol is not given: the volume is the one whose marker is on dir or, if dir is empty, the only known volume that is mounted
+func DiscoverVolUUID(dir string) (string, error) {
+	if dir != "" {
+		marker, err := ReadVolumeMarker(dir)
+		if os.IsNotExist(err) {
+			return "", fmt.Errorf("folder '%s' has no volume marker (use --vol)", dir)
+		}
+		return marker.UUID, err
+	}
+	found, err := find_volume_markers()
+	if err != nil {
+		return "", err
+	}
+	uuids := make([]string, 0)
+	names := make([]string, 0)
+	for _, f := range found {
+		vol, err := LoadVol(f.Marker.UUID)
+		if err != nil {
+			return "", err
+		}
+		if vol.UUID == f.Marker.UUID && !ContainsStr(uuids, vol.UUID) {
+			uuids = append(uuids, vol.UUID)
+			names = append(names, fmt.Sprintf("%s (on '%s')", vol.Name, f.Dir))
+		}
+	}
+	if len(uuids) == 0 {
+		return "", errors.New("none of the volumes in the database is mounted (or use --vol)")
+	}
+	if len(uuids) > 1 {
+		return "", errors.New("many volumes are mounted, choose one with --vol: " + strings.Join(names, ", "))
+	}
+	return uuids[0], nil
+}
+
+var volMarkCmd = &cobra.Command{
+	Use:   "mark [uuid or name]",
+	Short: "Writes the volume marker on the folder of a volume created without one",
+	Args:  cobra.ExactArgs(1),
+	Run:   volMark,
+}
+
+func volMark(cmd *cobra.Command, args []string) {
+	// Load DB
+	LoadDB(nil)
+	defer DB.Close()
+	vol := load_vol_or_die(args[0])
+	err := WriteVolumeMarker(VolAddFolder, vol)
+	if err != nil {
+		Log.Fatal(err)
+	}
+	Log.NoticeF("Marked '%s' as volume %s (%s)", VolAddFolder, vol.Name, vol.UUID)
+}
@@ -0,0 +1,335 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+// A change to the schema of databases created by older versions of blu-up. Versions must never be reused nor reordered.
+type Migration struct {
+	Version int
+	Name    string
+	Apply   func(tx *sql.Tx) error
+}
+
+// The first migrations were written before `schema_version` existed, so they check what is missing instead of trusting the version
+var Migrations []Migration = []Migration{
+	{1, "Add `inodes`.`snapshot_id`", func(tx *sql.Tx) error {
+		return add_column_if_missing(tx, "inodes", "snapshot_id", "INTEGER NOT NULL DEFAULT 0")
+	}},
+	{2, "Move blob volumes to `blob_locations`", migrate_blob_locations},
+	{3, "Add `inodes`.`change_time` and `inodes`.`inode_num`", func(tx *sql.Tx) error {
+		err := add_column_if_missing(tx, "inodes", "change_time", "INTEGER NOT NULL DEFAULT 0")
+		if err != nil {
+			return err
+		}
+		return add_column_if_missing(tx, "inodes", "inode_num", "INTEGER NOT NULL DEFAULT 0")
+	}},
+	{4, "Add `volumes`.`encryption`", func(tx *sql.Tx) error {
+		return add_column_if_missing(tx, "volumes", "encryption", "TEXT NOT NULL DEFAULT ''")
+	}},
+	{5, "Add `blob_locations`.`codec` and `blob_locations`.`stored_size`", func(tx *sql.Tx) error {
+		err := add_column_if_missing(tx, "blob_locations", "codec", "TEXT NOT NULL DEFAULT ''")
+		if err != nil {
+			return err
+		}
+		return add_column_if_missing(tx, "blob_locations", "stored_size", "INTEGER NOT NULL DEFAULT 0")
+	}},
+	{6, "Add `blob_locations`.`pack` and `blob_locations`.`pack_offset`", func(tx *sql.Tx) error {
+		err := add_column_if_missing(tx, "blob_locations", "pack", "TEXT NOT NULL DEFAULT ''")
+		if err != nil {
+			return err
+		}
+		return add_column_if_missing(tx, "blob_locations", "pack_offset", "INTEGER NOT NULL DEFAULT 0")
+	}},
+	{7, "Add hard link columns to `inodes`", func(tx *sql.Tx) error {
+		err := add_column_if_missing(tx, "inodes", "device", "INTEGER NOT NULL DEFAULT 0")
+		if err != nil {
+			return err
+		}
+		err = add_column_if_missing(tx, "inodes", "nlink", "INTEGER NOT NULL DEFAULT 0")
+		if err != nil {
+			return err
+		}
+		return add_column_if_missing(tx, "inodes", "link_group", "TEXT NOT NULL DEFAULT ''")
+	}},
+	{8, "Add `inodes`.`uid` and `inodes`.`gid`", func(tx *sql.Tx) error {
+		err := add_column_if_missing(tx, "inodes", "uid", "INTEGER NOT NULL DEFAULT -1")
+		if err != nil {
+			return err
+		}
+		return add_column_if_missing(tx, "inodes", "gid", "INTEGER NOT NULL DEFAULT -1")
+	}},
+	{9, "Add nanosecond times and device numbers to `inodes`", func(tx *sql.Tx) error {
+		for _, column := range []string{"mod_time_nsec", "change_time_nsec", "access_time", "access_time_nsec", "birth_time", "birth_time_nsec", "dev_major", "dev_minor"} {
+			err := add_column_if_missing(tx, "inodes", column, "INTEGER NOT NULL DEFAULT 0")
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}},
+	{10, "Convert `mode` strings to st_mode bits", func(tx *sql.Tx) error {
+		err := migrate_mode_column(tx, "inodes")
+		if err != nil {
+			return err
+		}
+		return migrate_mode_column(tx, "archive_members")
+	}},
+}
+
+const SCHEMA_VERSION_SQL = "CREATE TABLE IF NOT EXISTS `schema_version` (`version` INTEGER NOT NULL, `name` TEXT NOT NULL, `applied` INTEGER NOT NULL, PRIMARY KEY(`version`));"
+
+func LatestSchemaVersion() int {
+	return Migrations[len(Migrations)-1].Version
+}
+
+// Brings the database up to date in a single transaction: pending migrations first (they only touch tables that already exist) and then CREATE_DB_SQL for whatever is new
+func MigrateDB() error {
+	tx, err := DB.Begin()
+	if err != nil {
+		return err
+	}
+	err = migrate_db_tx(tx)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+func migrate_db_tx(tx *sql.Tx) error {
+	_, err := tx.Exec(SCHEMA_VERSION_SQL)
+	if err != nil {
+		return err
+	}
+	version, err := schema_version(tx)
+	if err != nil {
+		return err
+	}
+	if version > LatestSchemaVersion() {
+		return fmt.Errorf("database schema version %d is newer than the ones this version of blu-up knows (up to %d)", version, LatestSchemaVersion())
+	}
+	// New databases are created with the latest schema, so there is nothing to migrate
+	has_tables, err := table_exists(tx, "inodes")
+	if err != nil {
+		return err
+	}
+	for _, migration := range Migrations {
+		if migration.Version <= version {
+			continue
+		}
+		if has_tables {
+			Log.NoticeF("Migrating database to version %d: %s", migration.Version, migration.Name)
+			err = migration.Apply(tx)
+			if err != nil {
+				return fmt.Errorf("migration %d (%s) failed: %s", migration.Version, migration.Name, err)
+			}
+		}
+		_, err = tx.Exec("INSERT INTO `schema_version` (`version`, `name`, `applied`) VALUES (?, ?, ?);", migration.Version, migration.Name, time.Now().Unix())
+		if err != nil {
+			return err
+		}
+	}
+	_, err = tx.Exec(CREATE_DB_SQL)
+	return err
+}
+
+// Returns 0 for databases that never recorded a version
+func schema_version(q Querier) (int, error) {
+	var version sql.NullInt64
+	err := q.QueryRow("SELECT MAX(`version`) FROM `schema_version`;").Scan(&version)
+	return int(version.Int64), err
+}
+
+// Older databases stored a single `volume_uuid` in `blobs`, so we move it to `blob_locations` and rebuild `blobs` without it
+const MIGRATE_BLOB_LOCATIONS_SQL = "CREATE TABLE IF NOT EXISTS `blob_locations` (`hash` TEXT NOT NULL, `volume_uuid` TEXT NOT NULL, `added` INTEGER NOT NULL, `last_verified` INTEGER NOT NULL, PRIMARY KEY(`hash`,`volume_uuid`));\n" +
+	"INSERT OR IGNORE INTO `blob_locations` (`hash`, `volume_uuid`, `added`, `last_verified`) SELECT `hash`, `volume_uuid`, `first_added`, 0 FROM `blobs`;\n" +
+	"CREATE TABLE `blobs_new` (`hash` TEXT NOT NULL, `size` INTEGER NOT NULL, `first_added` INTEGER NOT NULL, PRIMARY KEY(`hash`));\n" +
+	"INSERT INTO `blobs_new` (`hash`, `size`, `first_added`) SELECT `hash`, `size`, `first_added` FROM `blobs`;\n" +
+	"DROP TABLE `blobs`;\n" +
+	"ALTER TABLE `blobs_new` RENAME TO `blobs`;"
+
+func migrate_blob_locations(tx *sql.Tx) error {
+	ok, err := column_exists(tx, "blobs", "volume_uuid")
+	if err != nil || !ok {
+		return err
+	}
+	_, err = tx.Exec(MIGRATE_BLOB_LOCATIONS_SQL)
+	return err
+}
+
+// `mode` used to be the string of os.FileMode (ex: -rwxr-xr-x), so we parse it into st_mode bits
+func migrate_mode_column(tx *sql.Tx, table string) error {
+	ok, decl_type, err := column_info(tx, table, "mode")
+	if err != nil || !ok || decl_type != "TEXT" {
+		return err
+	}
+	_, err = tx.Exec("ALTER TABLE `" + table + "` RENAME COLUMN `mode` TO `mode_str`;")
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("ALTER TABLE `" + table + "` ADD COLUMN `mode` INTEGER NOT NULL DEFAULT 0;")
+	if err != nil {
+		return err
+	}
+	rows, err := tx.Query("SELECT DISTINCT `mode_str` FROM `" + table + "`;")
+	if err != nil {
+		return err
+	}
+	strs := make([]string, 0)
+	for rows.Next() {
+		var str string
+		if err := rows.Scan(&str); err != nil {
+			rows.Close()
+			return err
+		}
+		strs = append(strs, str)
+	}
+	rows.Close()
+	for _, str := range strs {
+		mode, err := ParseModeStr(str)
+		if err != nil {
+			Log.WarningF("Failed to parse mode '%s' (it will be 0): %s", str, err)
+			continue
+		}
+		_, err = tx.Exec("UPDATE `"+table+"` SET `mode` = ? WHERE `mode_str` = ?;", FileModeToStatMode(mode), str)
+		if err != nil {
+			return err
+		}
+	}
+	_, err = tx.Exec("ALTER TABLE `" + table + "` DROP COLUMN `mode_str`;")
+	return err
+}
+
+func table_exists(q Querier, table string) (bool, error) {
+	var n int
+	err := q.QueryRow("SELECT COUNT(*) FROM `sqlite_master` WHERE `type` = 'table' AND `name` = ?;", table).Scan(&n)
+	return n > 0, err
+}
+
+func column_exists(q Querier, table, column string) (bool, error) {
+	ok, _, err := column_info(q, table, column)
+	return ok, err
+}
+
+// Tells whether the column exists and its declared type (missing tables have no columns)
+func column_info(q Querier, table, column string) (bool, string, error) {
+	rows, err := q.Query("PRAGMA table_info(`" + table + "`);")
+	if err != nil {
+		return false, "", err
+	}
+	defer rows.Close()
+	cols, err := rows.Columns()
+	if err != nil {
+		return false, "", err
+	}
+	for rows.Next() {
+		// cid, name, type, notnull, dflt_value, pk
+		vals := make([]interface{}, len(cols))
+		var name, decl_type string
+		for i := range vals {
+			vals[i] = new(interface{})
+		}
+		vals[1] = &name
+		vals[2] = &decl_type
+		if err := rows.Scan(vals...); err != nil {
+			return false, "", err
+		}
+		if name == column {
+			return true, strings.ToUpper(decl_type), nil
+		}
+	}
+	return false, "", rows.Err()
+}
+
+// Tables that do not exist yet are left for CREATE_DB_SQL
+func add_column_if_missing(tx *sql.Tx, table, column, decl string) error {
+	ok, err := table_exists(tx, table)
+	if err != nil || !ok {
+		return err
+	}
+	ok, err = column_exists(tx, table, column)
+	if err != nil || ok {
+		return err
+	}
+	Log.NoticeF("Adding column `%s`.`%s` to the database", table, column)
+	_, err = tx.Exec("ALTER TABLE `" + table + "` ADD COLUMN `" + column + "` " + decl + ";")
+	return err
+}
+
+var dbCmd = &cobra.Command{
+	Use:   "db",
+	Short: "Manage the database schema",
+}
+
+var dbMigrateCmd = &cobra.Command{
+	Use:   "migrate [db path]",
+	Short: "Applies the pending migrations to the database (this also happens whenever it is opened)",
+	Args:  cobra.MaximumNArgs(1),
+	Run:   dbMigrate,
+}
+
+func dbMigrate(cmd *cobra.Command, args []string) {
+	// Load DB
+	LoadDB(args)
+	defer DB.Close()
+	version, err := schema_version(DB)
+	if err != nil {
+		Log.Fatal(err)
+	}
+	Log.NoticeF("Database '%s' is at schema version %d", DBPath, version)
+}
+
+var dbStatusCmd = &cobra.Command{
+	Use:   "status [db path]",
+	Short: "Lists the migrations and whether they were applied to the database (without applying them)",
+	Args:  cobra.MaximumNArgs(1),
+	Run:   dbStatus,
+}
+
+func dbStatus(cmd *cobra.Command, args []string) {
+	// Open DB (but do not migrate it)
+	OpenDB(args)
+	defer DB.Close()
+	applied := make(map[int]time.Time)
+	ok, err := table_exists(DB, "schema_version")
+	if err != nil {
+		Log.Fatal(err)
+	}
+	if ok {
+		rows, err := DB.Query("SELECT `version`, `applied` FROM `schema_version`;")
+		if err != nil {
+			Log.Fatal(err)
+		}
+		for rows.Next() {
+			var version int
+			var t int64
+			if err := rows.Scan(&version, &t); err != nil {
+				Log.Fatal(err)
+			}
+			applied[version] = time.Unix(t, 0)
+		}
+		rows.Close()
+	}
+	n_pending := 0
+	for _, migration := range Migrations {
+		status := "pending"
+		if t, ok := applied[migration.Version]; ok {
+			status = t.Format("2006-01-02 15:04:05")
+		} else {
+			n_pending++
+		}
+		fmt.Printf("%3d %-19s %s\n", migration.Version, status, migration.Name)
+	}
+	for version := range applied {
+		if version > LatestSchemaVersion() {
+			Log.FatalF("The database has schema version %d, which is newer than the ones this version of blu-up knows", version)
+		}
+	}
+	fmt.Printf("%d of %d migrations pending\n", n_pending, len(Migrations))
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"syscall"
+	"testing"
+)
+
+// Schema of the first version of blu-up (before snapshots, blob locations and schema versions)
+const OLDEST_SCHEMA_SQL = "CREATE TABLE `volumes` (`uuid` TEXT NOT NULL, `name` TEXT NOT NULL, `desc` TEXT NOT NULL, PRIMARY KEY(`uuid`));\n" +
+	"CREATE TABLE `inodes` (`uuid` TEXT NOT NULL, `type` TEXT NOT NULL, `hash` TEXT NOT NULL, `compression` TEXT NOT NULL, `original_path` TEXT NOT NULL, `target_path` TEXT NOT NULL, `size` INTEGER NOT NULL, `user` TEXT NOT NULL, `group` TEXT NOT NULL, `mode` TEXT NOT NULL, `mod_time` INTEGER NOT NULL, `scan_time` INTEGER NOT NULL, PRIMARY KEY(`uuid`));\n" +
+	"CREATE TABLE `blobs` (`hash` TEXT NOT NULL, `size` INTEGER NOT NULL, `volume_uuid` TEXT NOT NULL, `first_added` INTEGER NOT NULL, PRIMARY KEY(`hash`));\n" +
+	"INSERT INTO `volumes` VALUES ('vol-1', 'disk', '');\n" +
+	"INSERT INTO `inodes` VALUES ('inode-1', 'f', 'SHA3-512:abc', '', '/home/me/run.sh', '', 3, 'me', 'me', '-rwxr-xr-x', 100, 200);\n" +
+	"INSERT INTO `inodes` VALUES ('inode-2', 'd', '', '', '/home/me', '', 0, 'me', 'me', 'drwxr-x---', 100, 200);\n" +
+	"INSERT INTO `blobs` VALUES ('SHA3-512:abc', 3, 'vol-1', 50);"
+
+func TestMigrateOldestDB(t *testing.T) {
+	open_test_db(t)
+	if _, err := DB.Exec(OLDEST_SCHEMA_SQL); err != nil {
+		t.Fatal(err)
+	}
+	if err := MigrateDB(); err != nil {
+		t.Fatal(err)
+	}
+	// Migrating again changes nothing
+	if err := MigrateDB(); err != nil {
+		t.Fatal(err)
+	}
+	if version, err := schema_version(DB); err != nil || version != LatestSchemaVersion() {
+		t.Errorf("schema version is %d (%v), expected %d", version, err, LatestSchemaVersion())
+	}
+	modes := map[string]uint32{"inode-1": syscall.S_IFREG | 0755, "inode-2": syscall.S_IFDIR | 0750}
+	for uuid, want := range modes {
+		var mode uint32
+		var snapshot_id, uid int64
+		err := DB.QueryRow("SELECT `mode`, `snapshot_id`, `uid` FROM `inodes` WHERE `uuid` = ?;", uuid).Scan(&mode, &snapshot_id, &uid)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if mode != want || snapshot_id != 0 || uid != -1 {
+			t.Errorf("%s: got mode %o, snapshot %d and uid %d, expected mode %o, snapshot 0 and uid -1", uuid, mode, snapshot_id, uid, want)
+		}
+	}
+	if ok, _ := column_exists(DB, "blobs", "volume_uuid"); ok {
+		t.Error("`blobs`.`volume_uuid` was not dropped")
+	}
+	loc, err := LoadBlobLocation(DB, "SHA3-512:abc", "vol-1")
+	if err != nil || loc.Hash == "" || loc.Added.Unix() != 50 {
+		t.Errorf("blob location was not moved: %+v (%v)", loc, err)
+	}
+	if vol, err := LoadVol("disk"); err != nil || vol.UUID != "vol-1" || vol.Encryption != "" {
+		t.Errorf("volume was not kept: %+v (%v)", vol, err)
+	}
+	if nodes, err := count_scanned_inodes(); err != nil || nodes != 2 {
+		t.Errorf("found %d inodes (%v), expected 2", nodes, err)
+	}
+}
+
+// Scans every inode, so columns added by migrations must all be readable
+func count_scanned_inodes() (int, error) {
+	rows, err := DB.Query("SELECT " + INODE_COLUMNS + " FROM `inodes`;")
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+	n := 0
+	for rows.Next() {
+		if _, err := ScanINode(rows); err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, rows.Err()
+}
+
+func TestMigrateNewDB(t *testing.T) {
+	open_test_db(t)
+	if err := MigrateDB(); err != nil {
+		t.Fatal(err)
+	}
+	var n int
+	if err := DB.QueryRow("SELECT COUNT(*) FROM `schema_version`;").Scan(&n); err != nil || n != len(Migrations) {
+		t.Errorf("new database recorded %d versions (%v), expected %d", n, err, len(Migrations))
+	}
+}
+
+func TestMigrateNewerDB(t *testing.T) {
+	open_test_db(t)
+	if err := MigrateDB(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := DB.Exec("INSERT INTO `schema_version` (`version`, `name`, `applied`) VALUES (?, 'from the future', 0);", LatestSchemaVersion()+1); err != nil {
+		t.Fatal(err)
+	}
+	if err := MigrateDB(); err == nil {
+		t.Error("a database newer than this version of blu-up was accepted")
+	}
+}
+
+// A failed migration must leave the database as it was
+func TestMigrateRollback(t *testing.T) {
+	open_test_db(t)
+	if _, err := DB.Exec(OLDEST_SCHEMA_SQL); err != nil {
+		t.Fatal(err)
+	}
+	old := Migrations
+	defer func() { Migrations = old }()
+	Migrations = append(Migrations[:len(Migrations):len(Migrations)], Migration{LatestSchemaVersion() + 1, "Fail", func(tx *sql.Tx) error {
+		return errors.New("failed on purpose")
+	}})
+	if err := MigrateDB(); err == nil {
+		t.Fatal("the failed migration was not reported")
+	}
+	if ok, _ := column_exists(DB, "inodes", "snapshot_id"); ok {
+		t.Error("migrations before the failed one were not rolled back")
+	}
+	if ok, _ := table_exists(DB, "schema_version"); ok {
+		t.Error("`schema_version` was created")
+	}
+}
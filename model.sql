@@ -1,8 +1,8 @@
-BEGIN TRANSACTION;
 CREATE TABLE IF NOT EXISTS `volumes` (
 	`uuid`	TEXT NOT NULL,
 	`name`	TEXT NOT NULL,
 	`desc`	TEXT NOT NULL,
+	`encryption`	TEXT NOT NULL DEFAULT '',
 	PRIMARY KEY(`uuid`)
 );
 CREATE TABLE IF NOT EXISTS `inodes` (
@@ -15,18 +15,89 @@ CREATE TABLE IF NOT EXISTS `inodes` (
 	`size`	INTEGER NOT NULL,
 	`user`	TEXT NOT NULL,
 	`group`	TEXT NOT NULL,
-	`mode`	TEXT NOT NULL,
+	`mode`	INTEGER NOT NULL,
 	`mod_time`	INTEGER NOT NULL,
 	`scan_time`	INTEGER NOT NULL,
+	`snapshot_id`	INTEGER NOT NULL DEFAULT 0,
+	`change_time`	INTEGER NOT NULL DEFAULT 0,
+	`inode_num`	INTEGER NOT NULL DEFAULT 0,
+	`device`	INTEGER NOT NULL DEFAULT 0,
+	`nlink`	INTEGER NOT NULL DEFAULT 0,
+	`link_group`	TEXT NOT NULL DEFAULT '',
+	`uid`	INTEGER NOT NULL DEFAULT -1,
+	`gid`	INTEGER NOT NULL DEFAULT -1,
+	`mod_time_nsec`	INTEGER NOT NULL DEFAULT 0,
+	`change_time_nsec`	INTEGER NOT NULL DEFAULT 0,
+	`access_time`	INTEGER NOT NULL DEFAULT 0,
+	`access_time_nsec`	INTEGER NOT NULL DEFAULT 0,
+	`birth_time`	INTEGER NOT NULL DEFAULT 0,
+	`birth_time_nsec`	INTEGER NOT NULL DEFAULT 0,
+	`dev_major`	INTEGER NOT NULL DEFAULT 0,
+	`dev_minor`	INTEGER NOT NULL DEFAULT 0,
 	PRIMARY KEY(`uuid`)
 );
 CREATE TABLE IF NOT EXISTS `blobs` (
 	`hash`	TEXT NOT NULL,
 	`size`	INTEGER NOT NULL,
-	`volume_uuid`	TEXT NOT NULL,
 	`first_added`	INTEGER NOT NULL,
 	PRIMARY KEY(`hash`)
 );
+CREATE TABLE IF NOT EXISTS `blob_locations` (
+	`hash`	TEXT NOT NULL,
+	`volume_uuid`	TEXT NOT NULL,
+	`added`	INTEGER NOT NULL,
+	`last_verified`	INTEGER NOT NULL,
+	`codec`	TEXT NOT NULL DEFAULT '',
+	`stored_size`	INTEGER NOT NULL DEFAULT 0,
+	`pack`	TEXT NOT NULL DEFAULT '',
+	`pack_offset`	INTEGER NOT NULL DEFAULT 0,
+	PRIMARY KEY(`hash`,`volume_uuid`)
+);
+CREATE TABLE IF NOT EXISTS `blob_chunks` (
+	`hash`	TEXT NOT NULL,
+	`idx`	INTEGER NOT NULL,
+	`chunk_hash`	TEXT NOT NULL,
+	`offset`	INTEGER NOT NULL,
+	`size`	INTEGER NOT NULL,
+	PRIMARY KEY(`hash`,`idx`)
+);
+CREATE TABLE IF NOT EXISTS `snapshots` (
+	`id`	INTEGER NOT NULL,
+	`source_root`	TEXT NOT NULL,
+	`host`	TEXT NOT NULL,
+	`volume_uuid`	TEXT NOT NULL,
+	`status`	TEXT NOT NULL,
+	`start_time`	INTEGER NOT NULL,
+	`end_time`	INTEGER NOT NULL,
+	`inodes_count`	INTEGER NOT NULL,
+	`bytes_count`	INTEGER NOT NULL,
+	`blobs_count`	INTEGER NOT NULL,
+	`errors_count`	INTEGER NOT NULL,
+	PRIMARY KEY(`id` AUTOINCREMENT)
+);
+CREATE TABLE IF NOT EXISTS `archive_members` (
+	`hash`	TEXT NOT NULL,
+	`path`	TEXT NOT NULL,
+	`type`	TEXT NOT NULL,
+	`target_path`	TEXT NOT NULL,
+	`size`	INTEGER NOT NULL,
+	`user`	TEXT NOT NULL,
+	`group`	TEXT NOT NULL,
+	`mode`	INTEGER NOT NULL,
+	`mod_time`	INTEGER NOT NULL,
+	PRIMARY KEY(`hash`,`path`)
+);
+CREATE TABLE IF NOT EXISTS `xattrs` (
+	`inode_uuid`	TEXT NOT NULL,
+	`name`	TEXT NOT NULL,
+	`value`	BLOB NOT NULL,
+	PRIMARY KEY(`inode_uuid`,`name`)
+);
+CREATE TABLE IF NOT EXISTS `settings` (
+	`key`	TEXT NOT NULL,
+	`value`	TEXT NOT NULL,
+	PRIMARY KEY(`key`)
+);
 CREATE INDEX IF NOT EXISTS `idx_inodes_user` ON `inodes` (
 	`user`	ASC
 );
@@ -51,4 +122,12 @@ CREATE INDEX IF NOT EXISTS `idx_inodes_hash` ON `inodes` (
 CREATE INDEX IF NOT EXISTS `idx_inodes_group` ON `inodes` (
 	`group`	ASC
 );
-COMMIT;
+CREATE INDEX IF NOT EXISTS `idx_inodes_snapshot_id` ON `inodes` (
+	`snapshot_id`	ASC
+);
+CREATE INDEX IF NOT EXISTS `idx_blob_locations_volume_uuid` ON `blob_locations` (
+	`volume_uuid`	ASC
+);
+CREATE INDEX IF NOT EXISTS `idx_blob_chunks_chunk_hash` ON `blob_chunks` (
+	`chunk_hash`	ASC
+);
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"errors"
+	"os/user"
+	"strconv"
+	"strings"
+)
+
+var FlagNumericOwner bool
+var FlagMapUser []string
+var FlagMapGroup []string
+
+// Owners from the backup (by name or id) that must become other owners (by id) on restore
+var RestoreUserMap map[string]int
+var RestoreGroupMap map[string]int
+
+// Numeric ids are the source of truth, names are only hints (they are empty when the id had no name on the scanned system)
+func lookup_owner_names(uid, gid uint32) (string, string) {
+	user_name, group_name := "", ""
+	if u, err := user.LookupId(strconv.FormatUint(uint64(uid), 10)); err == nil {
+		user_name = u.Username
+	}
+	if g, err := user.LookupGroupId(strconv.FormatUint(uint64(gid), 10)); err == nil {
+		group_name = g.Name
+	}
+	return user_name, group_name
+}
+
+func lookup_uid(name_or_id string) (int, error) {
+	if id, err := strconv.Atoi(name_or_id); err == nil {
+		return id, nil
+	}
+	u, err := user.Lookup(name_or_id)
+	if err != nil {
+		return -1, err
+	}
+	return strconv.Atoi(u.Uid)
+}
+
+func lookup_gid(name_or_id string) (int, error) {
+	if id, err := strconv.Atoi(name_or_id); err == nil {
+		return id, nil
+	}
+	g, err := user.LookupGroup(name_or_id)
+	if err != nil {
+		return -1, err
+	}
+	return strconv.Atoi(g.Gid)
+}
+
+// Parses pairs like old:new (both may be names or ids, but new must exist on this system)
+func ParseOwnerMap(pairs []string, lookup func(string) (int, error)) (map[string]int, error) {
+	owner_map := make(map[string]int)
+	for _, pair := range pairs {
+		parts := strings.SplitN(pair, ":", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, errors.New("invalid owner mapping (use old:new): " + pair)
+		}
+		id, err := lookup(parts[1])
+		if err != nil {
+			return nil, errors.New("unknown owner on mapping " + pair + ": " + err.Error())
+		}
+		owner_map[parts[0]] = id
+	}
+	return owner_map, nil
+}
+
+// Decides the id of the owner on this system: mappings first, then the name (unless --numeric-owner) and then the saved id
+func restore_owner_id(name string, id int64, owner_map map[string]int, lookup func(string) (int, error)) (int, bool) {
+	if new_id, ok := owner_map[name]; ok && name != "" {
+		return new_id, true
+	}
+	if new_id, ok := owner_map[strconv.FormatInt(id, 10)]; ok && id >= 0 {
+		return new_id, true
+	}
+	if !FlagNumericOwner && name != "" {
+		if new_id, err := lookup(name); err == nil {
+			return new_id, true
+		}
+	}
+	if id >= 0 {
+		return int(id), true
+	}
+	// Inodes saved before ids were stored have only names
+	return -1, false
+}
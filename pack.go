@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+
+	uuid "github.com/gjvnq/go.uuid"
+)
+
+// Small blobs are appended to pack files, so the volume does not end up with millions of tiny files
+const PACK_FOLDER = "PACKS"
+
+var FlagPackThreshold string
+var FlagPackSize string
+
+// Appends blobs to pack files of a volume. It is safe to use from many goroutines.
+type PackWriter struct {
+	Threshold int64 // Blobs smaller than this are packed
+	MaxSize   int64 // A new pack is started when the current one reaches this size
+	lock      sync.Mutex
+	pack      string
+	fptr_pack *os.File
+	fptr_idx  *os.File
+	size      int64
+}
+
+func NewPackWriter(threshold, max_size int64) *PackWriter {
+	return &PackWriter{Threshold: threshold, MaxSize: max_size}
+}
+
+// Enables packing of small blobs on a volume we are about to write to (if the user asked for it)
+func (vol *Vol) SetupPacker() error {
+	threshold, err := ParseSize(FlagPackThreshold)
+	if err != nil {
+		return err
+	}
+	if threshold == 0 {
+		return nil
+	}
+	max_size, err := ParseSize(FlagPackSize)
+	if err != nil {
+		return err
+	}
+	if max_size < threshold {
+		return fmt.Errorf("pack size (%d bytes) must not be smaller than the pack threshold (%d bytes)", max_size, threshold)
+	}
+	vol.Packer = NewPackWriter(threshold, max_size)
+	return nil
+}
+
+func (vol Vol) PackPath(pack string) string {
+	return filepath.Join(vol.Dir, PACK_FOLDER, pack+".pack")
+}
+
+// Name used for the blob in pack indexes (it must not reveal the hash on encrypted volumes)
+func (vol Vol) BlobName(hash string) string {
+	return filepath.Base(vol.BlobPath(hash))
+}
+
+// Appends an encoded blob to the current pack, loc gets the pack, offset and stored size
+func (w *PackWriter) Append(vol Vol, data []byte, loc *BlobLocation) error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	if w.fptr_pack == nil || w.size+int64(len(data)) > w.MaxSize {
+		err := w.rotate(vol)
+		if err != nil {
+			return err
+		}
+	}
+	offset := w.size
+	n, err := vol.limit_writer(w.fptr_pack).Write(data)
+	w.size += int64(n)
+	if err != nil {
+		return err
+	}
+	// The index on the volume allows rebuilding the catalog without the database
+	_, err = fmt.Fprintf(w.fptr_idx, "%s %d %d %s\n", vol.BlobName(loc.Hash), offset, len(data), loc.Codec)
+	if err != nil {
+		return err
+	}
+	loc.Pack = w.pack
+	loc.PackOffset = offset
+	loc.StoredSize = int64(len(data))
+	return nil
+}
+
+// Closes the current pack (if any) and starts a new one. Packs are never appended to after they are closed.
+func (w *PackWriter) rotate(vol Vol) error {
+	err := w.close()
+	if err != nil {
+		return err
+	}
+	w.pack = uuid.NewV4().String()
+	path := vol.PackPath(w.pack)
+	err = os.MkdirAll(filepath.Dir(path), os.ModePerm)
+	if err != nil {
+		return err
+	}
+	w.fptr_pack, err = os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	w.fptr_idx, err = os.OpenFile(filepath.Join(filepath.Dir(path), w.pack+".idx"), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	w.size = 0
+	Log.DebugF("Started pack '%s'", path)
+	return nil
+}
+
+func (w *PackWriter) close() error {
+	var err error
+	for _, fptr := range []*os.File{w.fptr_pack, w.fptr_idx} {
+		if fptr == nil {
+			continue
+		}
+		if e := fptr.Sync(); e != nil && err == nil {
+			err = e
+		}
+		if e := fptr.Close(); e != nil && err == nil {
+			err = e
+		}
+	}
+	w.fptr_pack = nil
+	w.fptr_idx = nil
+	return err
+}
+
+func (w *PackWriter) Close() error {
+	if w == nil {
+		return nil
+	}
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	return w.close()
+}
+
+// Encodes a small blob in memory and appends it to a pack
+func (vol Vol) write_packed_blob(in io.Reader, loc *BlobLocation, expected_size int64) error {
+	buf := &bytes.Buffer{}
+	size, _, err := vol.encode_blob(in, *loc, buf)
+	if err != nil {
+		return err
+	}
+	if size != expected_size {
+		Log.WarningF("Blob size (%d bytes) is different from the size copied (%d bytes) for blob %s", expected_size, size, loc.Hash)
+		return errors.New("file size does not match number of copied bytes")
+	}
+	return vol.Packer.Append(vol, buf.Bytes(), loc)
+}
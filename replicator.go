@@ -0,0 +1,132 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/spf13/cobra"
+)
+
+var ReplicateFromVol string
+var ReplicateFromFolder string
+var ReplicateToVol string
+var ReplicateToFolder string
+
+var volReplicateCmd = &cobra.Command{
+	Use:   "replicate",
+	Short: "Copies the blobs of a volume that are missing on another volume",
+	Args:  cobra.NoArgs,
+	Run:   volReplicate,
+}
+
+func load_vol_or_die(name_or_uuid string) Vol {
+	vol, err := LoadVol(name_or_uuid)
+	if err != nil {
+		Log.FatalF("Failed to load volume %s", name_or_uuid)
+	}
+	if vol.UUID == "" {
+		Log.FatalF("Volume not found %s", name_or_uuid)
+	}
+	return vol
+}
+
+func volReplicate(cmd *cobra.Command, args []string) {
+	// Load DB
+	LoadDB(args)
+	defer DB.Close()
+
+	// Set a few variables
+	ReplicateFromFolder, _ = filepath.Abs(ReplicateFromFolder)
+	ReplicateToFolder, _ = filepath.Abs(ReplicateToFolder)
+	if ReplicateFromFolder == ReplicateToFolder {
+		Log.FatalF("Replication origin ('%s') and destination ('%s') cannot be equal", ReplicateFromFolder, ReplicateToFolder)
+	}
+	from_vol := load_vol_or_die(ReplicateFromVol)
+	to_vol := load_vol_or_die(ReplicateToVol)
+	if from_vol.UUID == to_vol.UUID {
+		Log.FatalF("Cannot replicate volume %s to itself", from_vol.UUID)
+	}
+	if err := from_vol.Mount(ReplicateFromFolder); err != nil {
+		Log.Fatal(err)
+	}
+	if err := to_vol.Mount(ReplicateToFolder); err != nil {
+		Log.Fatal(err)
+	}
+	if err := to_vol.SetupPacker(); err != nil {
+		Log.Fatal(err)
+	}
+	// List what is missing (we must not write to the DB while reading from it)
+	orders, err := replicator_list(from_vol, to_vol)
+	if err != nil {
+		Log.Fatal(err)
+	}
+	Log.InfoF("Found %d blobs on volume %s (%s) missing on volume %s (%s)", len(orders), from_vol.Name, from_vol.UUID, to_vol.Name, to_vol.UUID)
+	n_ok, n_fail := 0, 0
+	for _, order := range orders {
+		err := replicator_main(order, from_vol, to_vol)
+		if err != nil {
+			Log.ErrorF("Failed to replicate blob '%s': %s", order.From.Hash, err)
+			n_fail++
+		} else {
+			n_ok++
+		}
+	}
+	if err := to_vol.Packer.Close(); err != nil {
+		Log.Fatal(err)
+	}
+	if n_fail > 0 {
+		Log.ErrorF("Failed to replicate %d of %d blobs (try running verify on volume %s)", n_fail, len(orders), from_vol.Name)
+	}
+	Log.NoticeF("Finished replicating %d blobs from '%s' to '%s'", n_ok, ReplicateFromFolder, ReplicateToFolder)
+}
+
+type ReplicateOrder struct {
+	From BlobLocation
+	Size int64
+}
+
+func replicator_list(from_vol, to_vol Vol) ([]ReplicateOrder, error) {
+	rows, err := DB.Query("SELECT "+BLOB_LOCATION_COLUMNS+", `blobs`.`size` FROM `blob_locations` JOIN `blobs` ON `blobs`.`hash` = `blob_locations`.`hash` WHERE `blob_locations`.`volume_uuid` = ? AND `blob_locations`.`hash` NOT IN (SELECT `hash` FROM `blob_locations` WHERE `volume_uuid` = ?);", from_vol.UUID, to_vol.UUID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	orders := make([]ReplicateOrder, 0)
+	for rows.Next() {
+		order := ReplicateOrder{}
+		order.From, err = ScanBlobLocation(rows, &order.Size)
+		if err != nil {
+			return nil, err
+		}
+		orders = append(orders, order)
+	}
+	return orders, rows.Err()
+}
+
+// Blobs are decrypted and encrypted again, as each volume has its own key (the codec is kept)
+func replicator_main(order ReplicateOrder, from_vol, to_vol Vol) error {
+	Log.DebugF("Replicating '%s' to '%s'", from_vol.BlobPath(order.From.Hash), to_vol.BlobPath(order.From.Hash))
+	fptr_in, err := from_vol.OpenBlob(order.From)
+	if err != nil {
+		return err
+	}
+	defer fptr_in.Close()
+	loc := NewBlobLocation(order.From.Hash, to_vol.UUID)
+	loc.Codec = order.From.Codec
+	err = to_vol.WriteBlob(fptr_in, &loc, order.Size)
+	if err == nil {
+		// Checking the copy also checks the original
+		err = to_vol.CheckBlob(loc, order.Size)
+	}
+	if err != nil {
+		if loc.Pack == "" {
+			os.Remove(to_vol.BlobPath(loc.Hash))
+		}
+		return err
+	}
+	err = loc.Save(DB)
+	if err != nil {
+		return err
+	}
+	return loc.MarkVerified()
+}
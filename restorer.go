@@ -0,0 +1,265 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+var RestoreFromPrefix string
+var RestoreToFolder string
+var RestoreSnapshotID int64
+
+// Lists the most recent inode (of a complete snapshot, or of the one chosen) for every path under RestoreFromPrefix sorted by path (parents always come before their children)
+func restore_list_inodes() ([]INode, error) {
+	prefix := filepath.Clean(RestoreFromPrefix)
+	like := escape_like(strings.TrimSuffix(prefix, "/")) + "/%"
+	query := "SELECT " + INODE_COLUMNS + " FROM `inodes` WHERE (`original_path` = ? OR `original_path` LIKE ? ESCAPE '\\')"
+	query_args := []interface{}{prefix, like}
+	if RestoreSnapshotID != 0 {
+		query += " AND `snapshot_id` = ?"
+		query_args = append(query_args, RestoreSnapshotID)
+	} else {
+		query += " AND " + complete_snapshot_cond("inodes")
+	}
+	rows, err := DB.Query(query+" ORDER BY `original_path` ASC, `scan_time` ASC, `rowid` ASC;", query_args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	nodes := make([]INode, 0)
+	for rows.Next() {
+		node, err := ScanINode(rows)
+		if err != nil {
+			return nil, err
+		}
+		// Keep only the latest scan of each path
+		if len(nodes) > 0 && nodes[len(nodes)-1].OriginalPath == node.OriginalPath {
+			nodes[len(nodes)-1] = node
+		} else {
+			nodes = append(nodes, node)
+		}
+	}
+	return nodes, rows.Err()
+}
+
+func escape_like(s string) string {
+	s = strings.Replace(s, "\\", "\\\\", -1)
+	s = strings.Replace(s, "%", "\\%", -1)
+	s = strings.Replace(s, "_", "\\_", -1)
+	return s
+}
+
+// Translates the original path of an inode into its path inside RestoreToFolder
+func restore_dest_path(original_path string) string {
+	prefix := filepath.Clean(RestoreFromPrefix)
+	rel := strings.TrimPrefix(original_path, prefix)
+	return filepath.Join(RestoreToFolder, rel)
+}
+
+func restorer_main(nodes []INode) (int, int) {
+	n_ok, n_fail := 0, 0
+	dirs := make([]INode, 0)
+	// Where the first file of each hard link group was restored
+	links := make(map[string]string)
+	for _, node := range nodes {
+		var err error
+		dest := restore_dest_path(node.OriginalPath)
+		first, linked := links[node.LinkGroup]
+		if node.Type == INODE_TYPE_FILE && node.LinkGroup != "" && linked {
+			err = restore_hard_link(node, first, dest)
+		} else {
+			err = restore_inode(node, dest)
+			if err == nil && node.Type == INODE_TYPE_FILE && node.LinkGroup != "" {
+				links[node.LinkGroup] = dest
+			}
+		}
+		if err != nil {
+			Log.ErrorF("Failed to restore '%s' to '%s': %s", node.OriginalPath, dest, err)
+			n_fail++
+			continue
+		}
+		n_ok++
+		if node.Type == INODE_TYPE_DIRECTORY {
+			// Restoring the children changes the directory mod time, so we fix it at the end
+			dirs = append(dirs, node)
+			continue
+		}
+		restore_metadata(node, dest)
+	}
+	// Children first
+	for i := len(dirs) - 1; i >= 0; i-- {
+		restore_metadata(dirs[i], restore_dest_path(dirs[i].OriginalPath))
+	}
+	return n_ok, n_fail
+}
+
+func restore_inode(node INode, dest string) error {
+	Log.DebugF("Restoring '%s' to '%s'", node.OriginalPath, dest)
+	// Ensure parent folder exists
+	err := os.MkdirAll(filepath.Dir(dest), os.ModePerm)
+	if err != nil {
+		return err
+	}
+
+	switch node.Type {
+	case INODE_TYPE_DIRECTORY:
+		if node.Compression != "" && node.Hash != "" {
+			return restore_packed_folder(node, dest)
+		}
+		return os.MkdirAll(dest, os.ModePerm)
+	case INODE_TYPE_SYMBOLIC_LINK:
+		if _, err := os.Lstat(dest); err == nil {
+			os.Remove(dest)
+		}
+		return os.Symlink(node.TargetPath, dest)
+	case INODE_TYPE_FILE:
+		return restore_file(node, dest)
+	case INODE_TYPE_FIFO, INODE_TYPE_CHAR_DEVICE, INODE_TYPE_BLOCK_DEVICE:
+		return restore_special_file(node, dest)
+	}
+	return errors.New(ERR_INVALID_INODE_TYPE)
+}
+
+func restore_file(node INode, dest string) error {
+	fptr_in, err := restore_open_blob(node.Hash)
+	if err != nil {
+		return err
+	}
+	defer fptr_in.Close()
+	fptr_out, err := os.Create(dest)
+	if err != nil {
+		return err
+	}
+	defer fptr_out.Close()
+	// Hash what we write to double check everything
+	hash, size, err := hash_reader_like(node.Hash, io.TeeReader(fptr_in, fptr_out))
+	if err != nil {
+		return err
+	}
+	if size != node.Size {
+		Log.WarningF("Restored file '%s' has %d bytes instead of %d", dest, size, node.Size)
+		return errors.New("restored file size does not match")
+	}
+	if hash != node.Hash {
+		Log.WarningF("Restored file '%s' does not match the oficial hash", dest)
+		return errors.New("restored file hash does not match")
+	}
+	return fptr_out.Close()
+}
+
+// FIFOs can be made by anyone, but devices only by root
+func restore_special_file(node INode, dest string) error {
+	if node.Type != INODE_TYPE_FIFO && os.Geteuid() != 0 {
+		return errors.New("only root can restore device nodes")
+	}
+	if _, err := os.Lstat(dest); err == nil {
+		os.Remove(dest)
+	}
+	return make_special_file(dest, node.Type, 0600, node.DevMajor, node.DevMinor)
+}
+
+func restore_open_blob(hash string) (io.ReadCloser, error) {
+	chunks, err := LoadBlobChunks(DB, hash)
+	if err != nil {
+		return nil, err
+	}
+	if len(chunks) > 0 {
+		return BackupVol.OpenChunkedBlob(chunks), nil
+	}
+	loc, err := LoadBlobLocation(DB, hash, BackupVolUUID)
+	if err != nil {
+		return nil, err
+	}
+	if loc.Hash == "" {
+		warn_missing_blob(hash)
+		return nil, errors.New("blob not found on volume")
+	}
+	fptr, err := BackupVol.OpenBlob(loc)
+	if err != nil {
+		warn_missing_blob(hash)
+	}
+	return fptr, err
+}
+
+// Tells the user which volumes should have the blob
+func warn_missing_blob(hash string) {
+	uuids, _ := LoadBlobVolUUIDs(hash)
+	if len(uuids) == 0 {
+		Log.WarningF("Blob '%s' not found on volume %s nor on any other volume", hash, BackupVolUUID)
+		return
+	}
+	Log.WarningF("Blob '%s' not found on volume %s (try volumes: %s)", hash, BackupVolUUID, strings.Join(uuids, ", "))
+}
+
+// Packed folders are stored as a single archive that contains the folder itself
+func restore_packed_folder(node INode, dest string) error {
+	if _, err := archive_codec(node.Compression); err != nil {
+		return err
+	}
+	fptr_in, err := restore_open_blob(node.Hash)
+	if err != nil {
+		return err
+	}
+	defer fptr_in.Close()
+	// The archive is named after the original folder, so we extract it on a temporary folder and move it
+	tmp_dir, err := ioutil.TempDir(filepath.Dir(dest), "tmp_restore_")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp_dir)
+	err = extract_archive(fptr_in, node.Compression, tmp_dir)
+	if err != nil {
+		Log.WarningF("restore_packed_folder(path = '%s') (extract_archive): %s ", dest, err)
+		return err
+	}
+	os.RemoveAll(dest)
+	return os.Rename(filepath.Join(tmp_dir, filepath.Base(node.OriginalPath)), dest)
+}
+
+// Re-applies mode, owner and modification time. Failures here are not fatal.
+func restore_metadata(node INode, dest string) {
+	// Owner (only root can give files away)
+	if os.Geteuid() == 0 {
+		uid, ok := restore_owner_id(node.User, node.UID, RestoreUserMap, lookup_uid)
+		if !ok {
+			Log.WarningF("Unknown user '%s' for '%s'", node.User, dest)
+		}
+		gid, ok := restore_owner_id(node.Group, node.GID, RestoreGroupMap, lookup_gid)
+		if !ok {
+			Log.WarningF("Unknown group '%s' for '%s'", node.Group, dest)
+		}
+		if err := os.Lchown(dest, uid, gid); err != nil {
+			Log.WarningF("Failed to change owner of '%s': %s", dest, err)
+		}
+	}
+	// Links have no mode of their own
+	if node.Type == INODE_TYPE_SYMBOLIC_LINK {
+		restore_xattrs(node, dest)
+		restore_times(node, dest)
+		return
+	}
+	if err := os.Chmod(dest, StatModeToFileMode(node.Mode)); err != nil {
+		Log.WarningF("Failed to change mode of '%s': %s", dest, err)
+	}
+	// After the owner and mode, as changing them clears capabilities and ACLs
+	restore_xattrs(node, dest)
+	restore_times(node, dest)
+}
+
+// Birth and change times can't be set, so only access and modification times are restored
+func restore_times(node INode, dest string) {
+	atime := node.AccessTime
+	if atime.Unix() == 0 {
+		// Inodes saved before access times were stored
+		atime = time.Now()
+	}
+	if err := lchtimes(dest, atime, node.ModTime); err != nil {
+		Log.WarningF("Failed to change mod time of '%s': %s", dest, err)
+	}
+}
@@ -0,0 +1,310 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/logrusorgru/aurora"
+	"github.com/spf13/cobra"
+)
+
+var SearchPathGlob string
+var SearchRegex string
+var SearchName string
+var SearchMinSize string
+var SearchMaxSize string
+var SearchNewer string
+var SearchOlder string
+var SearchUser string
+var SearchGroup string
+var SearchType string
+var SearchPerm string
+var SearchHash string
+var SearchVol string
+var SearchSnapshotID int64
+var FlagAllVersions bool
+var FlagSearchArchives bool
+
+var searchCmd = &cobra.Command{
+	Use:   "search",
+	Short: "Searches the database for inodes",
+	Long:  "Searches the database for inodes and shows which volumes have their blobs. By default only the latest version of each path is shown.",
+	Args:  cobra.NoArgs,
+	Run:   search,
+}
+
+// Parses sizes like 123, 10K, 1.5M, 2G and 1T (powers of 1024)
+func ParseSize(str string) (int64, error) {
+	str = strings.ToUpper(strings.TrimSpace(str))
+	str = strings.TrimSuffix(str, "B")
+	mult := float64(1)
+	if str != "" {
+		switch str[len(str)-1] {
+		case 'K':
+			mult = 1 << 10
+		case 'M':
+			mult = 1 << 20
+		case 'G':
+			mult = 1 << 30
+		case 'T':
+			mult = 1 << 40
+		}
+		if mult != 1 {
+			str = str[:len(str)-1]
+		}
+	}
+	val, err := strconv.ParseFloat(str, 64)
+	if err != nil || val < 0 {
+		return 0, errors.New("invalid size: " + str)
+	}
+	return int64(val * mult), nil
+}
+
+// Parses dates like 2006-01-02, 2006-01-02 15:04:05 and RFC 3339 (local time zone if none is given)
+func ParseDate(str string) (time.Time, error) {
+	for _, layout := range []string{time.RFC3339, "2006-01-02 15:04:05", "2006-01-02T15:04:05", "2006-01-02"} {
+		t, err := time.ParseInLocation(layout, str, time.Local)
+		if err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, errors.New("invalid date: " + str)
+}
+
+// Parses permissions like find -perm: 4000 (exactly these), -4000 (at least these) or /6000 (any of these). Returns the SQL condition and its arguments.
+func ParsePerm(str string) (string, []interface{}, error) {
+	cond := "(`mode` & 4095) = ?"
+	n_args := 1
+	if strings.HasPrefix(str, "-") {
+		cond = "(`mode` & ?) = ?"
+		n_args = 2
+		str = str[1:]
+	} else if strings.HasPrefix(str, "/") {
+		cond = "(`mode` & ?) != 0"
+		str = str[1:]
+	}
+	perm, err := strconv.ParseUint(str, 8, 32)
+	if err != nil || perm > 07777 {
+		return "", nil, errors.New("invalid permissions (use octal like 644, -4000 or /6000): " + str)
+	}
+	args := make([]interface{}, n_args)
+	for i := range args {
+		args[i] = perm
+	}
+	return cond, args, nil
+}
+
+// Files inside packed folders look like inodes (they have the hash of the archive, so we know where to find them)
+const SEARCH_ARCHIVE_MEMBERS_FROM = "(SELECT `inodes`.`uuid` AS `uuid`, `archive_members`.`type` AS `type`, `inodes`.`hash` AS `hash`, `inodes`.`compression` AS `compression`, `inodes`.`original_path` || '/' || `archive_members`.`path` AS `original_path`, `archive_members`.`target_path` AS `target_path`, `archive_members`.`size` AS `size`, `archive_members`.`user` AS `user`, `archive_members`.`group` AS `group`, `archive_members`.`mode` AS `mode`, `archive_members`.`mod_time` AS `mod_time`, `inodes`.`scan_time` AS `scan_time`, `inodes`.`snapshot_id` AS `snapshot_id`, 0 AS `change_time`, 0 AS `inode_num`, 0 AS `device`, 0 AS `nlink`, '' AS `link_group`, -1 AS `uid`, -1 AS `gid`, 0 AS `mod_time_nsec`, 0 AS `change_time_nsec`, 0 AS `access_time`, 0 AS `access_time_nsec`, 0 AS `birth_time`, 0 AS `birth_time_nsec`, 0 AS `dev_major`, 0 AS `dev_minor`, `inodes`.`original_path` AS `packed_path`, `inodes`.`rowid` AS `rowid` FROM `archive_members` JOIN `inodes` ON `inodes`.`hash` = `archive_members`.`hash` AND `inodes`.`type` = '" + INODE_TYPE_DIRECTORY + "') AS `inodes`"
+
+// Builds the query with the filters that SQLite can handle by itself. Each row of from is a version of the inode at latest_path (so we know which version is the latest).
+func search_build_query(from, latest_path string) (string, []interface{}) {
+	conds := make([]string, 0)
+	args := make([]interface{}, 0)
+	if SearchPathGlob != "" {
+		conds = append(conds, "`original_path` GLOB ?")
+		args = append(args, SearchPathGlob)
+	}
+	if SearchMinSize != "" {
+		size, err := ParseSize(SearchMinSize)
+		if err != nil {
+			Log.Fatal(err)
+		}
+		conds = append(conds, "`size` >= ?")
+		args = append(args, size)
+	}
+	if SearchMaxSize != "" {
+		size, err := ParseSize(SearchMaxSize)
+		if err != nil {
+			Log.Fatal(err)
+		}
+		conds = append(conds, "`size` <= ?")
+		args = append(args, size)
+	}
+	if SearchNewer != "" {
+		t, err := ParseDate(SearchNewer)
+		if err != nil {
+			Log.Fatal(err)
+		}
+		conds = append(conds, "`mod_time` >= ?")
+		args = append(args, t.Unix())
+	}
+	if SearchOlder != "" {
+		t, err := ParseDate(SearchOlder)
+		if err != nil {
+			Log.Fatal(err)
+		}
+		conds = append(conds, "`mod_time` < ?")
+		args = append(args, t.Unix())
+	}
+	// Owners may be given by name or id
+	if SearchUser != "" {
+		conds = append(conds, "(`user` = ? OR `uid` = ?)")
+		args = append(args, SearchUser, search_owner_id(SearchUser))
+	}
+	if SearchGroup != "" {
+		conds = append(conds, "(`group` = ? OR `gid` = ?)")
+		args = append(args, SearchGroup, search_owner_id(SearchGroup))
+	}
+	if SearchType != "" {
+		if SearchType != INODE_TYPE_FILE && SearchType != INODE_TYPE_DIRECTORY && SearchType != INODE_TYPE_SYMBOLIC_LINK && !is_special_type(SearchType) {
+			Log.FatalF("Invalid inode type '%s' (use f, d, l, p, c or b)", SearchType)
+		}
+		conds = append(conds, "`type` = ?")
+		args = append(args, SearchType)
+	}
+	if SearchPerm != "" {
+		cond, perm_args, err := ParsePerm(SearchPerm)
+		if err != nil {
+			Log.Fatal(err)
+		}
+		conds = append(conds, cond)
+		args = append(args, perm_args...)
+	}
+	if SearchHash != "" {
+		// Allow searching by a prefix of the hash
+		conds = append(conds, "`hash` LIKE ? ESCAPE '\\'")
+		args = append(args, escape_like(SearchHash)+"%")
+	}
+	if SearchVol != "" {
+		vol, err := LoadVol(SearchVol)
+		if err != nil {
+			Log.Fatal(err)
+		}
+		if vol.UUID == "" {
+			Log.FatalF("Volume not found %s", SearchVol)
+		}
+		// Chunked files are on the volume when all their chunks are (like LoadBlobVolUUIDs)
+		conds = append(conds, "(`hash` IN (SELECT `hash` FROM `blob_locations` WHERE `volume_uuid` = ?) OR `hash` IN (SELECT `bc`.`hash` FROM `blob_chunks` AS `bc` LEFT JOIN `blob_locations` AS `bl` ON `bl`.`hash` = `bc`.`chunk_hash` AND `bl`.`volume_uuid` = ? GROUP BY `bc`.`hash` HAVING COUNT(DISTINCT `bc`.`chunk_hash`) = COUNT(DISTINCT `bl`.`hash`)))")
+		args = append(args, vol.UUID, vol.UUID)
+	}
+	if SearchSnapshotID != 0 {
+		conds = append(conds, "`snapshot_id` = ?")
+		args = append(args, SearchSnapshotID)
+	} else if !FlagAllVersions {
+		conds = append(conds, complete_snapshot_cond("inodes"), "`scan_time` = (SELECT MAX(`i2`.`scan_time`) FROM `inodes` AS `i2` WHERE `i2`.`original_path` = `inodes`.`"+latest_path+"` AND "+complete_snapshot_cond("i2")+")")
+	}
+
+	query := "SELECT " + INODE_COLUMNS + " FROM " + from
+	if len(conds) > 0 {
+		query += " WHERE " + strings.Join(conds, " AND ")
+	}
+	return query + " ORDER BY `original_path` ASC, `scan_time` ASC, `rowid` ASC;", args
+}
+
+// Names never match an id
+func search_owner_id(str string) int64 {
+	id, err := strconv.ParseInt(str, 10, 64)
+	if err != nil || id < 0 {
+		return -2
+	}
+	return id
+}
+
+func search(cmd *cobra.Command, args []string) {
+	var re *regexp.Regexp
+	var err error
+	flag_empty := true
+
+	if SearchRegex != "" {
+		re, err = regexp.Compile(SearchRegex)
+		if err != nil {
+			Log.Fatal(err)
+		}
+	}
+	if SearchName != "" {
+		if _, err := filepath.Match(SearchName, ""); err != nil {
+			Log.Fatal(err)
+		}
+	}
+	// Load DB
+	LoadDB(args)
+	defer DB.Close()
+	// Query
+	query, query_args := search_build_query("`inodes`", "original_path")
+	nodes := search_query(query, query_args, re)
+	if FlagSearchArchives {
+		query, query_args = search_build_query(SEARCH_ARCHIVE_MEMBERS_FROM, "packed_path")
+		nodes = append(nodes, search_query(query, query_args, re)...)
+		sort.SliceStable(nodes, func(i, j int) bool {
+			return nodes[i].OriginalPath < nodes[j].OriginalPath
+		})
+	}
+	// Print results
+	vol_names := make(map[string]string)
+	for _, node := range nodes {
+		flag_empty = false
+		fmt.Println(node.Type, node.Size, node.ModTime.Format("2006-01-02 15:04:05"), aurora.Bold(node.OriginalPath), search_vols_str(node.Hash, vol_names))
+	}
+	if flag_empty {
+		fmt.Println("no inodes found")
+	}
+}
+
+func search_query(query string, query_args []interface{}, re *regexp.Regexp) []INode {
+	rows, err := DB.Query(query, query_args...)
+	if err != nil {
+		Log.Fatal(err)
+	}
+	defer rows.Close()
+	nodes := make([]INode, 0)
+	for rows.Next() {
+		node, err := ScanINode(rows)
+		if err != nil {
+			Log.Fatal(err)
+		}
+		// Filters that SQLite can't do
+		if re != nil && !re.MatchString(node.OriginalPath) {
+			continue
+		}
+		if SearchName != "" {
+			if ok, _ := filepath.Match(SearchName, filepath.Base(node.OriginalPath)); !ok {
+				continue
+			}
+		}
+		// Many scans may happen in the same second
+		if !FlagAllVersions && len(nodes) > 0 && nodes[len(nodes)-1].OriginalPath == node.OriginalPath {
+			nodes[len(nodes)-1] = node
+		} else {
+			nodes = append(nodes, node)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		Log.Fatal(err)
+	}
+	return nodes
+}
+
+// Lists the names of the volumes with the blob (uses cache to avoid loading the same volume many times)
+func search_vols_str(hash string, vol_names map[string]string) string {
+	if hash == "" {
+		return ""
+	}
+	uuids, err := LoadBlobVolUUIDs(hash)
+	if err != nil {
+		Log.Fatal(err)
+	}
+	if len(uuids) == 0 {
+		return "[no volumes]"
+	}
+	names := make([]string, 0, len(uuids))
+	for _, vol_uuid := range uuids {
+		name, ok := vol_names[vol_uuid]
+		if !ok {
+			vol, _ := LoadVol(vol_uuid)
+			name = vol.Name
+			if name == "" {
+				name = vol_uuid
+			}
+			vol_names[vol_uuid] = name
+		}
+		names = append(names, name)
+	}
+	return "[" + strings.Join(names, ", ") + "]"
+}
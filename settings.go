@@ -0,0 +1,26 @@
+package main
+
+// Settings that belong to a database (not to a single run)
+const SETTING_HASH_ALGORITHM = "hash_algorithm"
+
+// Returns def if the setting was never saved
+func GetSetting(key, def string) (string, error) {
+	var value string
+	err := DB.QueryRow("SELECT `value` FROM `settings` WHERE `key` = ?;", key).Scan(&value)
+	if err != nil {
+		if err.Error() == "sql: no rows in result set" {
+			return def, nil
+		}
+		Log.Warning(err)
+		return "", err
+	}
+	return value, nil
+}
+
+func SetSetting(key, value string) error {
+	_, err := DB.Exec("INSERT OR REPLACE INTO `settings` (`key`, `value`) VALUES (?, ?);", key, value)
+	if err != nil {
+		Log.Warning(err)
+	}
+	return err
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/logrusorgru/aurora"
+	"github.com/spf13/cobra"
+)
+
+const SNAPSHOT_STATUS_RUNNING = "running"
+const SNAPSHOT_STATUS_COMPLETE = "complete"
+const SNAPSHOT_STATUS_ABORTED = "aborted"
+const SNAPSHOT_STATUS_FAILED = "failed" // Finished, but some batch of inodes could not be saved
+
+// A snapshot is a single run of the backup command
+type Snapshot struct {
+	ID          int64     `json:id`
+	SourceRoot  string    `json:source_root`
+	Host        string    `json:host`
+	VolUUID     string    `json:volume_uuid`
+	Status      string    `json:status`
+	StartTime   time.Time `json:start_time`
+	EndTime     time.Time `json:end_time`
+	INodesCount int64     `json:inodes_count`
+	BytesCount  int64     `json:bytes_count`
+	BlobsCount  int64     `json:blobs_count`
+	ErrorsCount int64     `json:errors_count`
+}
+
+// The snapshot being made by the current backup (if any)
+var BackupSnapshot *Snapshot
+var FlagListINodes bool
+var FlagForceRm bool
+
+// Inodes of backups that were aborted (or are still running) never count as the latest version of a path. Inodes saved before snapshots existed have no snapshot.
+func complete_snapshot_cond(table string) string {
+	return "(`" + table + "`.`snapshot_id` = 0 OR `" + table + "`.`snapshot_id` IN (SELECT `id` FROM `snapshots` WHERE `status` = '" + SNAPSHOT_STATUS_COMPLETE + "'))"
+}
+
+const SNAPSHOT_COLUMNS = "`id`, `source_root`, `host`, `volume_uuid`, `status`, `start_time`, `end_time`, `inodes_count`, `bytes_count`, `blobs_count`, `errors_count`"
+
+func NewSnapshot(source_root, vol_uuid string) *Snapshot {
+	snap := &Snapshot{}
+	snap.SourceRoot = source_root
+	snap.VolUUID = vol_uuid
+	snap.Host, _ = os.Hostname()
+	snap.Status = SNAPSHOT_STATUS_RUNNING
+	snap.StartTime = time.Now()
+	return snap
+}
+
+func ScanSnapshot(row RowScanner) (Snapshot, error) {
+	snap := Snapshot{}
+	var start_time, end_time int64
+	err := row.Scan(&snap.ID, &snap.SourceRoot, &snap.Host, &snap.VolUUID, &snap.Status, &start_time, &end_time, &snap.INodesCount, &snap.BytesCount, &snap.BlobsCount, &snap.ErrorsCount)
+	snap.StartTime = time.Unix(start_time, 0)
+	// Running snapshots have no end time (older versions stored the zero time.Time, which is before the epoch)
+	if end_time > 0 {
+		snap.EndTime = time.Unix(end_time, 0)
+	}
+	return snap, err
+}
+
+func LoadSnapshot(id int64) (Snapshot, error) {
+	snap, err := ScanSnapshot(DB.QueryRow("SELECT "+SNAPSHOT_COLUMNS+" FROM `snapshots` WHERE `id` = ?;", id))
+	if err != nil {
+		if err.Error() == "sql: no rows in result set" {
+			err = nil
+		} else {
+			Log.Warning(err)
+		}
+	}
+	return snap, err
+}
+
+// Inserts the snapshot and sets its ID
+func (snap *Snapshot) Save() error {
+	res, err := DB.Exec("INSERT INTO `snapshots` (`source_root`, `host`, `volume_uuid`, `status`, `start_time`, `end_time`, `inodes_count`, `bytes_count`, `blobs_count`, `errors_count`) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?);", snap.SourceRoot, snap.Host, snap.VolUUID, snap.Status, snap.StartTime.Unix(), unix_or_zero(snap.EndTime), snap.INodesCount, snap.BytesCount, snap.BlobsCount, snap.ErrorsCount)
+	if err != nil {
+		Log.Warning(err)
+		return err
+	}
+	snap.ID, err = res.LastInsertId()
+	return err
+}
+
+// Saves status, end time and counters
+func (snap *Snapshot) Update(q Querier) error {
+	_, err := q.Exec("UPDATE `snapshots` SET `status` = ?, `end_time` = ?, `inodes_count` = ?, `bytes_count` = ?, `blobs_count` = ?, `errors_count` = ? WHERE `id` = ?;", snap.Status, unix_or_zero(snap.EndTime), atomic.LoadInt64(&snap.INodesCount), atomic.LoadInt64(&snap.BytesCount), atomic.LoadInt64(&snap.BlobsCount), atomic.LoadInt64(&snap.ErrorsCount), snap.ID)
+	if err != nil {
+		Log.Warning(err)
+	}
+	return err
+}
+
+// Completed backups finish inside the transaction of their last batch, so their inodes become visible all at once
+func (snap *Snapshot) Finish(q Querier, status string) error {
+	snap.Status = status
+	snap.EndTime = time.Now()
+	return snap.Update(q)
+}
+
+// Counters may be changed by many workers at the same time
+func (snap *Snapshot) AddINode(size int64) {
+	atomic.AddInt64(&snap.INodesCount, 1)
+	atomic.AddInt64(&snap.BytesCount, size)
+}
+
+func (snap *Snapshot) AddBlob() {
+	atomic.AddInt64(&snap.BlobsCount, 1)
+}
+
+func (snap *Snapshot) AddError() {
+	atomic.AddInt64(&snap.ErrorsCount, 1)
+}
+
+func parse_snapshot_id(str string) int64 {
+	id, err := strconv.ParseInt(str, 10, 64)
+	if err != nil {
+		Log.FatalF("Invalid snapshot id '%s'", str)
+	}
+	return id
+}
+
+var snapshotCmd = &cobra.Command{
+	Use:   "snapshot",
+	Short: "Manage snapshots (backup runs)",
+}
+
+var snapshotLsCmd = &cobra.Command{
+	Use:   "ls",
+	Short: "Lists the snapshots in the database",
+	Args:  cobra.NoArgs,
+	Run:   snapshotLs,
+}
+
+func snapshotLs(cmd *cobra.Command, args []string) {
+	flag_empty := true
+
+	// Load DB
+	LoadDB(args)
+	defer DB.Close()
+	// Query
+	rows, err := DB.Query("SELECT " + SNAPSHOT_COLUMNS + " FROM `snapshots` ORDER BY `id` ASC;")
+	if err != nil {
+		Log.Fatal(err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		flag_empty = false
+		snap, err := ScanSnapshot(rows)
+		if err != nil {
+			Log.Fatal(err)
+		}
+		fmt.Println(aurora.Bold(snap.ID), snap.StartTime.Format(time.RFC3339), snap.Status, snap.Host+":"+snap.SourceRoot, snap.VolUUID, snap.INodesCount, "inodes")
+	}
+	if flag_empty {
+		fmt.Println("no snapshots in the database")
+	}
+}
+
+var snapshotShowCmd = &cobra.Command{
+	Use:   "show [id]",
+	Short: "Shows the details of a snapshot",
+	Args:  cobra.ExactArgs(1),
+	Run:   snapshotShow,
+}
+
+func snapshotShow(cmd *cobra.Command, args []string) {
+	// Load DB
+	LoadDB(nil)
+	defer DB.Close()
+	// Query
+	snap, err := LoadSnapshot(parse_snapshot_id(args[0]))
+	if err != nil {
+		Log.Fatal(err)
+	}
+	if snap.ID == 0 {
+		Log.FatalF("Snapshot not found %s", args[0])
+	}
+	vol, _ := LoadVol(snap.VolUUID)
+	fmt.Println("ID:     ", aurora.Bold(snap.ID))
+	fmt.Println("Status: ", snap.Status)
+	fmt.Println("Source: ", snap.Host+":"+snap.SourceRoot)
+	fmt.Println("Volume: ", snap.VolUUID, vol.Name)
+	fmt.Println("Started:", snap.StartTime.Format(time.RFC3339))
+	if !snap.EndTime.IsZero() {
+		fmt.Println("Ended:  ", snap.EndTime.Format(time.RFC3339), "("+snap.EndTime.Sub(snap.StartTime).String()+")")
+	}
+	fmt.Println("INodes: ", snap.INodesCount)
+	fmt.Println("Bytes:  ", snap.BytesCount)
+	fmt.Println("Blobs:  ", snap.BlobsCount, "(new)")
+	fmt.Println("Errors: ", snap.ErrorsCount)
+	if !FlagListINodes {
+		return
+	}
+	rows, err := DB.Query("SELECT `type`, `size`, `original_path` FROM `inodes` WHERE `snapshot_id` = ? ORDER BY `original_path` ASC;", snap.ID)
+	if err != nil {
+		Log.Fatal(err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var inode_type, path string
+		var size int64
+		err := rows.Scan(&inode_type, &size, &path)
+		if err != nil {
+			Log.Fatal(err)
+		}
+		fmt.Println(inode_type, size, path)
+	}
+}
+
+var snapshotRmCmd = &cobra.Command{
+	Use:   "rm [id]",
+	Short: "Removes a snapshot and its inodes from the database (blobs are kept)",
+	Args:  cobra.ExactArgs(1),
+	Run:   snapshotRm,
+}
+
+func snapshotRm(cmd *cobra.Command, args []string) {
+	// Load DB
+	LoadDB(nil)
+	defer DB.Close()
+	// Query
+	id := parse_snapshot_id(args[0])
+	snap, err := LoadSnapshot(id)
+	if err != nil {
+		Log.Fatal(err)
+	}
+	if snap.ID == 0 {
+		Log.FatalF("Snapshot not found %s", args[0])
+	}
+	// Its backup may still be saving inodes
+	if snap.Status == SNAPSHOT_STATUS_RUNNING && !FlagForceRm {
+		Log.FatalF("Snapshot %d is still running (use --force if its backup died without marking it as aborted)", id)
+	}
+	tx, err := DB.Begin()
+	if err != nil {
+		Log.Fatal(err)
+	}
+	res, err := tx.Exec("DELETE FROM `snapshots` WHERE `id` = ?;", id)
+	if err != nil {
+		tx.Rollback()
+		Log.Fatal(err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		tx.Rollback()
+		Log.FatalF("Snapshot not found %s", args[0])
+	}
+	_, err = tx.Exec("DELETE FROM `xattrs` WHERE `inode_uuid` IN (SELECT `uuid` FROM `inodes` WHERE `snapshot_id` = ?);", id)
+	if err != nil {
+		tx.Rollback()
+		Log.Fatal(err)
+	}
+	res, err = tx.Exec("DELETE FROM `inodes` WHERE `snapshot_id` = ?;", id)
+	if err != nil {
+		tx.Rollback()
+		Log.Fatal(err)
+	}
+	err = tx.Commit()
+	if err != nil {
+		Log.Fatal(err)
+	}
+	n, _ := res.RowsAffected()
+	Log.NoticeF("Removed snapshot %d and its %d inodes", id, n)
+}
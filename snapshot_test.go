@@ -0,0 +1,29 @@
+package main
+
+import "testing"
+
+func TestSnapshotEndTime(t *testing.T) {
+	open_test_db(t)
+	if err := MigrateDB(); err != nil {
+		t.Fatal(err)
+	}
+	snap := NewSnapshot("/src", "test-vol")
+	if err := snap.Save(); err != nil {
+		t.Fatal(err)
+	}
+	var end_time int64
+	if err := DB.QueryRow("SELECT `end_time` FROM `snapshots` WHERE `id` = ?;", snap.ID).Scan(&end_time); err != nil || end_time != 0 {
+		t.Errorf("running snapshot stored end time %d (%v), expected 0", end_time, err)
+	}
+	loaded, err := LoadSnapshot(snap.ID)
+	if err != nil || !loaded.EndTime.IsZero() {
+		t.Errorf("running snapshot loaded with end time %v (%v)", loaded.EndTime, err)
+	}
+	if err := snap.Finish(DB, SNAPSHOT_STATUS_COMPLETE); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err = LoadSnapshot(snap.ID)
+	if err != nil || loaded.EndTime.Unix() != snap.EndTime.Unix() {
+		t.Errorf("finished snapshot loaded with end time %v (%v), expected %v", loaded.EndTime, err, snap.EndTime)
+	}
+}
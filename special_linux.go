@@ -0,0 +1,52 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// Birth time is only available through statx (and not on every filesystem), the zero time means unknown
+func stat_birth_time(path string) time.Time {
+	var stx unix.Statx_t
+	err := unix.Statx(unix.AT_FDCWD, path, unix.AT_SYMLINK_NOFOLLOW, unix.STATX_BTIME, &stx)
+	if err != nil || stx.Mask&unix.STATX_BTIME == 0 {
+		return time.Time{}
+	}
+	return time.Unix(stx.Btime.Sec, int64(stx.Btime.Nsec))
+}
+
+func stat_access_time(stat *syscall.Stat_t) time.Time {
+	return time.Unix(stat.Atim.Unix())
+}
+
+func stat_change_time(stat *syscall.Stat_t) time.Time {
+	return time.Unix(stat.Ctim.Unix())
+}
+
+func device_numbers(rdev uint64) (uint32, uint32) {
+	return unix.Major(rdev), unix.Minor(rdev)
+}
+
+// Creates FIFOs and device nodes (the later only work as root)
+func make_special_file(path, inode_type string, perm uint32, major, minor uint32) error {
+	switch inode_type {
+	case INODE_TYPE_FIFO:
+		return unix.Mkfifo(path, perm)
+	case INODE_TYPE_CHAR_DEVICE:
+		return unix.Mknod(path, unix.S_IFCHR|perm, int(unix.Mkdev(major, minor)))
+	case INODE_TYPE_BLOCK_DEVICE:
+		return unix.Mknod(path, unix.S_IFBLK|perm, int(unix.Mkdev(major, minor)))
+	}
+	return unix.EINVAL
+}
+
+// Like os.Chtimes, but with nanoseconds and without following links
+func lchtimes(path string, atime, mtime time.Time) error {
+	times := []unix.Timespec{unix.NsecToTimespec(atime.UnixNano()), unix.NsecToTimespec(mtime.UnixNano())}
+	return unix.UtimesNanoAt(unix.AT_FDCWD, path, times, unix.AT_SYMLINK_NOFOLLOW)
+}
@@ -0,0 +1,37 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"errors"
+	"os"
+	"syscall"
+	"time"
+)
+
+func stat_birth_time(path string) time.Time {
+	return time.Time{}
+}
+
+// The fields of Stat_t differ on every system, so the access time is unknown
+func stat_access_time(stat *syscall.Stat_t) time.Time {
+	return time.Time{}
+}
+
+// Without the change time, unchanged files are recognized by size, inode and modification time
+func stat_change_time(stat *syscall.Stat_t) time.Time {
+	return time.Time{}
+}
+
+func device_numbers(rdev uint64) (uint32, uint32) {
+	return 0, 0
+}
+
+func make_special_file(path, inode_type string, perm uint32, major, minor uint32) error {
+	return errors.New("special files can't be restored on this system")
+}
+
+func lchtimes(path string, atime, mtime time.Time) error {
+	return os.Chtimes(path, atime, mtime)
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+)
+
+// Temporary files (like archives of packed folders) are staged outside the source tree, on a folder that belongs to a single run
+const STAGING_PREFIX = "blu-up-staging-"
+
+// Small archives are kept in memory (and copied from there), as long as all of them together stay under the budget
+const STAGING_MEMORY_LIMIT = 8 * 1024 * 1024
+const STAGING_MEMORY_BUDGET = 64 * 1024 * 1024
+
+var FlagTmpDir string
+var StagingDir string
+var StagedMemory int64
+
+// Creates the staging folder for this run (its name has our PID, so other runs know whether it is stale)
+func CreateStagingDir(tmp_dir string) error {
+	if tmp_dir == "" {
+		tmp_dir = os.TempDir()
+	}
+	sweep_staging(tmp_dir)
+	dir, err := ioutil.TempDir(tmp_dir, fmt.Sprintf("%s%d-", STAGING_PREFIX, os.Getpid()))
+	if err != nil {
+		return err
+	}
+	StagingDir, err = filepath.Abs(dir)
+	Log.DebugF("Staging temporary files on '%s'", StagingDir)
+	return err
+}
+
+func RemoveStagingDir() {
+	if StagingDir == "" {
+		return
+	}
+	err := os.RemoveAll(StagingDir)
+	if err != nil {
+		Log.WarningF("Failed to delete staging folder '%s': %s", StagingDir, err)
+	}
+	StagingDir = ""
+}
+
+// Removes staging folders left by runs that crashed (i.e. whose process is gone)
+func sweep_staging(tmp_dir string) {
+	children, err := ioutil.ReadDir(tmp_dir)
+	if err != nil {
+		Log.Warning(err)
+		return
+	}
+	for _, child := range children {
+		if !child.IsDir() || !strings.HasPrefix(child.Name(), STAGING_PREFIX) {
+			continue
+		}
+		pid, err := strconv.Atoi(strings.SplitN(strings.TrimPrefix(child.Name(), STAGING_PREFIX), "-", 2)[0])
+		if err != nil || pid == os.Getpid() || syscall.Kill(pid, 0) != syscall.ESRCH {
+			continue
+		}
+		path := filepath.Join(tmp_dir, child.Name())
+		Log.NoticeF("Deleting stale staging folder '%s'", path)
+		err = os.RemoveAll(path)
+		if err != nil {
+			Log.Warning(err)
+		}
+	}
+}
+
+// Deletes a staged file (or forgets an archive kept in memory) as soon as it is not needed anymore
+func unstage(path string, data []byte) {
+	if data != nil {
+		atomic.AddInt64(&StagedMemory, -int64(len(data)))
+		return
+	}
+	if StagingDir == "" || !strings.HasPrefix(path, StagingDir+"/") {
+		return
+	}
+	err := os.Remove(path)
+	if err != nil && !os.IsNotExist(err) {
+		Log.Warning(err)
+	}
+}
+
+// Keeps what is written in memory while it is small, then moves it to a file on the staging folder
+type spill_writer struct {
+	prefix string
+	buf    []byte
+	fptr   *os.File
+}
+
+func (w *spill_writer) Write(p []byte) (int, error) {
+	if w.fptr == nil && !w.reserve(len(p)) {
+		err := w.spill()
+		if err != nil {
+			return 0, err
+		}
+	}
+	if w.fptr != nil {
+		return w.fptr.Write(p)
+	}
+	w.buf = append(w.buf, p...)
+	return len(p), nil
+}
+
+func (w *spill_writer) reserve(n int) bool {
+	if len(w.buf)+n > STAGING_MEMORY_LIMIT {
+		return false
+	}
+	if atomic.AddInt64(&StagedMemory, int64(n)) > STAGING_MEMORY_BUDGET {
+		atomic.AddInt64(&StagedMemory, -int64(n))
+		return false
+	}
+	return true
+}
+
+func (w *spill_writer) spill() error {
+	fptr, err := ioutil.TempFile(StagingDir, w.prefix)
+	if err != nil {
+		return err
+	}
+	// Remember to delete the file later (if the copier does not do it first)
+	MarkedForDeletionLock.Lock()
+	MarkedForDeletion = append(MarkedForDeletion, fptr.Name())
+	MarkedForDeletionLock.Unlock()
+	w.fptr = fptr
+	_, err = fptr.Write(w.buf)
+	atomic.AddInt64(&StagedMemory, -int64(len(w.buf)))
+	w.buf = nil
+	return err
+}
+
+// Returns either the path of the staged file or the data kept in memory
+func (w *spill_writer) Close() (string, []byte, error) {
+	if w.fptr != nil {
+		return w.fptr.Name(), nil, w.fptr.Close()
+	}
+	if w.buf == nil {
+		w.buf = []byte{}
+	}
+	return "", w.buf, nil
+}
@@ -1,8 +1,8 @@
 package main
 
 import (
+	"io"
 	"os"
-	"path/filepath"
 	"sync"
 )
 
@@ -14,29 +14,34 @@ type VerifyOrder struct {
 	Hash string
 	Size int64
 	Path string
+	Loc  BlobLocation
 }
 
 func verifier_producer() {
 	defer VerifierWG.Done()
 	defer close(BlobsToVerifyCh)
 
-	// Query
-	rows, err := DB.Query("SELECT `hash`, `size` FROM `blobs` WHERE `volume_uuid` = ?;", BackupVolUUID)
+	// List everything first, as the consumers write to the DB and must not wait for this query to finish
+	rows, err := DB.Query("SELECT "+BLOB_LOCATION_COLUMNS+", `blobs`.`size` FROM `blob_locations` JOIN `blobs` ON `blobs`.`hash` = `blob_locations`.`hash` WHERE `blob_locations`.`volume_uuid` = ?;", BackupVolUUID)
 	if err != nil {
 		Log.Fatal(err)
 	}
-	defer rows.Close()
+	orders := make([]VerifyOrder, 0)
 	for rows.Next() {
-		var hash string
 		var size int64
-		err := rows.Scan(&hash, &size)
+		loc, err := ScanBlobLocation(rows, &size)
 		if err != nil {
 			Log.Fatal(err)
 		}
 		order := VerifyOrder{}
-		order.Hash = hash
+		order.Hash = loc.Hash
 		order.Size = size
-		order.Path = filepath.Join(BackupToFolder, Hash2Path(hash))
+		order.Path = BackupVol.LocationPath(loc)
+		order.Loc = loc
+		orders = append(orders, order)
+	}
+	rows.Close()
+	for _, order := range orders {
 		Log.DebugF("Adding '%s' for verification", order.Path)
 		BlobsToVerifyCh <- order
 	}
@@ -70,35 +75,13 @@ func verifier_consumer_main(order VerifyOrder, repair bool) {
 	}
 
 	Log.DebugF("Verifing '%s'", order.Path)
-	info, err := os.Lstat(order.Path)
-	if err != nil {
-		Log.LogF(level, "Failed to get file size for '%s': %s ", order.Path, err.Error())
-		add_blob_to_repair(order, repair)
-		return
-	}
-	// Check size
-	if info.Size() != order.Size {
-		Log.LogF(level, "Real file size (%d bytes) is different from blob file size (%d bytes) for file %s", info.Size(), order.Size, order.Path)
-		add_blob_to_repair(order, repair)
-		return
-	}
-	// Check hash
-	hash, size_hashed, err := hash_file(order.Path)
+	err := BackupVol.CheckBlob(order.Loc, order.Size)
 	if err != nil {
-		Log.LogF(level, "Failed to hash file '%s': %s", order.Path, err.Error())
-		add_blob_to_repair(order, repair)
-		return
-	}
-	if order.Size != size_hashed {
-		Log.LogF(level, "Oficial blob size (%d bytes) is different from the size hashed (%d bytes)", order.Size, size_hashed)
-		add_blob_to_repair(order, repair)
-		return
-	}
-	if order.Hash != hash {
-		Log.LogF(level, "Oficial blob hash does not match copied file hash for '%s'", order.Path)
+		Log.LogF(level, "Blob '%s' is broken: %s", order.Hash, err)
 		add_blob_to_repair(order, repair)
 		return
 	}
+	order.Loc.MarkVerified()
 }
 
 func verifier_fixer() {
@@ -114,37 +97,51 @@ func verifier_fixer() {
 	}
 }
 
+// A file (or part of it) that might have the content of a blob
+type FixCandidate struct {
+	Path   string
+	Offset int64
+	Whole  bool
+}
+
 func verifier_fixer_main(order VerifyOrder) {
 	Log.InfoF("Looking for files to repair blob %s", order.Hash)
-	// Look for inodes that might still have the same blob
-	rows, err := DB.Query("SELECT `original_path` FROM `inodes` WHERE `hash`= ? AND `type` = ? GROUP BY `original_path`;", order.Hash, INODE_TYPE_FILE)
+	// Look for inodes that might still have the same blob (either the whole file or one of its chunks)
+	rows, err := DB.Query("SELECT `original_path`, 0, 1 FROM `inodes` WHERE `hash`= ? AND `type` = ? GROUP BY `original_path` UNION SELECT `inodes`.`original_path`, `blob_chunks`.`offset`, 0 FROM `blob_chunks` JOIN `inodes` ON `inodes`.`hash` = `blob_chunks`.`hash` WHERE `blob_chunks`.`chunk_hash` = ? AND `inodes`.`type` = ? GROUP BY `inodes`.`original_path`;", order.Hash, INODE_TYPE_FILE, order.Hash, INODE_TYPE_FILE)
 	if err != nil {
 		Log.Error(err)
+		Log.ErrorF("Failed to repair blob '%s'", order.Hash)
+		return
 	}
-	paths := make([]string, 0)
+	candidates := make([]FixCandidate, 0)
 	for rows.Next() {
-		var path string
-		err := rows.Scan(&path)
+		candidate := FixCandidate{}
+		err := rows.Scan(&candidate.Path, &candidate.Offset, &candidate.Whole)
 		if err != nil {
 			Log.Error(err)
 		}
-		paths = append(paths, path)
+		candidates = append(candidates, candidate)
 	}
 	rows.Close()
 	// Attempt to use those inodes to repair blob
-	for _, path := range paths {
+	for _, candidate := range candidates {
+		path := candidate.Path
 		info, err := os.Lstat(path)
 		if err != nil {
 			Log.DebugF("Failed to get file size for '%s': %s ", path, err.Error())
 			continue
 		}
 		// Check size
-		if info.Size() != order.Size {
+		if candidate.Whole && info.Size() != order.Size {
 			Log.DebugF("Real file size (%d bytes) is different from blob file size (%d bytes) for file %s", info.Size(), order.Size, path)
 			continue
 		}
+		if !candidate.Whole && info.Size() < candidate.Offset+order.Size {
+			Log.DebugF("File '%s' is too small (%d bytes) to have the chunk", path, info.Size())
+			continue
+		}
 		// Check hash
-		hash, size_hashed, err := hash_file(path)
+		hash, size_hashed, err := verifier_fixer_hash(candidate, order)
 		if err != nil {
 			Log.DebugF("Failed to hash file '%s': %s", path, err.Error())
 			continue
@@ -158,7 +155,7 @@ func verifier_fixer_main(order VerifyOrder) {
 			continue
 		}
 		// File is usable, let's copy it
-		err = copy_file(path, order.Path, order.Size)
+		err = verifier_fixer_copy(candidate, order)
 		if err == nil {
 			Log.NoticeF("Successfully repaired blob '%s' using file '%s'", order.Hash, path)
 			return
@@ -166,3 +163,35 @@ func verifier_fixer_main(order VerifyOrder) {
 	}
 	Log.ErrorF("Failed to repair blob '%s'", order.Hash)
 }
+
+func verifier_fixer_hash(candidate FixCandidate, order VerifyOrder) (string, int64, error) {
+	fptr, err := os.Open(candidate.Path)
+	if err != nil {
+		return "", 0, err
+	}
+	defer fptr.Close()
+	return hash_reader_like(order.Hash, io.NewSectionReader(fptr, candidate.Offset, order.Size))
+}
+
+func verifier_fixer_copy(candidate FixCandidate, order VerifyOrder) error {
+	fptr, err := os.Open(candidate.Path)
+	if err != nil {
+		return err
+	}
+	defer fptr.Close()
+	// Keep the same codec (packs are never rewritten, so a packed blob is repaired into its own file)
+	loc := order.Loc
+	err = BackupVol.WriteBlob(io.NewSectionReader(fptr, candidate.Offset, order.Size), &loc, order.Size)
+	if err != nil {
+		return err
+	}
+	err = BackupVol.CheckBlob(loc, order.Size)
+	if err != nil {
+		return err
+	}
+	err = loc.Update()
+	if err != nil {
+		return err
+	}
+	return loc.MarkVerified()
+}
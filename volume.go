@@ -1,7 +1,10 @@
 package main
 
 import (
+	"errors"
 	"fmt"
+	"os"
+	"path/filepath"
 
 	uuid "github.com/gjvnq/go.uuid"
 	"github.com/logrusorgru/aurora"
@@ -9,11 +12,19 @@ import (
 )
 
 type Vol struct {
-	UUID string `json:uuid`
-	Name string `json:name`
-	Desc string `json:desc`
+	UUID       string      `json:uuid`
+	Name       string      `json:name`
+	Desc       string      `json:desc`
+	Encryption string      `json:encryption` // Empty if the blobs are not encrypted
+	Dir        string      `json:-`          // Where the volume is mounted
+	Keys       VolKeys     `json:-`
+	Packer     *PackWriter `json:-` // Only set when small blobs should be packed
+	Limiter    *BwLimiter  `json:-` // Only set when the I/O to the volume is limited
 }
 
+var FlagEncrypt bool
+var VolAddFolder string
+
 func NewVol() Vol {
 	vol := Vol{}
 	vol.UUID = uuid.NewV4().String()
@@ -22,7 +33,7 @@ func NewVol() Vol {
 
 func LoadVol(name_or_uuid string) (Vol, error) {
 	vol := Vol{}
-	err := DB.QueryRow("SELECT `uuid`, `name`, `desc` FROM `volumes` WHERE `uuid` = ? OR `name` = ?;", name_or_uuid, name_or_uuid).Scan(&vol.UUID, &vol.Name, &vol.Desc)
+	err := DB.QueryRow("SELECT `uuid`, `name`, `desc`, `encryption` FROM `volumes` WHERE `uuid` = ? OR `name` = ?;", name_or_uuid, name_or_uuid).Scan(&vol.UUID, &vol.Name, &vol.Desc, &vol.Encryption)
 	if err != nil {
 		if err.Error() == "sql: no rows in result set" {
 			err = nil
@@ -33,6 +44,38 @@ func LoadVol(name_or_uuid string) (Vol, error) {
 	return vol, err
 }
 
+// Sets the folder where the volume is mounted (looking for it if dir is empty), checks its marker and unlocks it (if it is encrypted)
+func (vol *Vol) Mount(dir string) error {
+	var err error
+	if dir == "" {
+		dir, err = DiscoverVolumeDir(vol.UUID)
+		if err != nil {
+			return err
+		}
+		Log.NoticeF("Found volume %s on '%s'", vol.Name, dir)
+	}
+	vol.Dir, err = filepath.Abs(dir)
+	if err != nil {
+		return err
+	}
+	err = vol.CheckMarker()
+	if err != nil {
+		return err
+	}
+	if vol.Encryption == "" {
+		return nil
+	}
+	if vol.Encryption != ENC_SCHEME_XCHACHA20 {
+		return errors.New("unsupported encryption scheme: " + vol.Encryption)
+	}
+	passphrase, err := get_passphrase("Passphrase for volume "+vol.Name, false)
+	if err != nil {
+		return err
+	}
+	vol.Keys, err = LoadKeyFile(vol.Dir, passphrase)
+	return err
+}
+
 var volCmd = &cobra.Command{
 	Use:   "vol",
 	Short: "Manage volumes",
@@ -58,8 +101,41 @@ func volAdd(cmd *cobra.Command, args []string) {
 	if len(args) > 1 {
 		vol.Desc = args[1]
 	}
-	_, err := DB.Exec("INSERT INTO `volumes` (`uuid`, `name`, `desc`) VALUES (?, ?, ?);", vol.UUID, vol.Name, vol.Desc)
+	var passphrase []byte
+	if FlagEncrypt {
+		// The key file lives on the volume itself
+		if VolAddFolder == "" {
+			Log.Fatal("encrypted volumes require --dir")
+		}
+		var err error
+		passphrase, err = get_passphrase("New passphrase for volume "+vol.Name, true)
+		if err != nil {
+			Log.Fatal(err)
+		}
+		vol.Encryption = ENC_SCHEME_XCHACHA20
+	}
+	// Nothing is written to the volume folder unless the volume could be added
+	_, err := DB.Exec("INSERT INTO `volumes` (`uuid`, `name`, `desc`, `encryption`) VALUES (?, ?, ?, ?);", vol.UUID, vol.Name, vol.Desc, vol.Encryption)
+	if err != nil {
+		Log.Fatal(err)
+	}
+	if VolAddFolder == "" {
+		return
+	}
+	if FlagEncrypt {
+		err = CreateKeyFile(VolAddFolder, passphrase)
+		if err != nil {
+			DB.Exec("DELETE FROM `volumes` WHERE `uuid` = ?;", vol.UUID)
+			Log.Fatal(err)
+		}
+	}
+	err = WriteVolumeMarker(VolAddFolder, vol)
 	if err != nil {
+		// CreateKeyFile never overwrites, so the key file is ours
+		if FlagEncrypt {
+			os.Remove(filepath.Join(VolAddFolder, ENC_KEY_FILE))
+		}
+		DB.Exec("DELETE FROM `volumes` WHERE `uuid` = ?;", vol.UUID)
 		Log.Fatal(err)
 	}
 }
@@ -80,6 +156,11 @@ func volRm(cmd *cobra.Command, args []string) {
 	if err != nil {
 		Log.Fatal(err)
 	}
+	// The blobs are no longer reachable through this volume
+	_, err = DB.Exec("DELETE FROM `blob_locations` WHERE `volume_uuid` = ?", args[0])
+	if err != nil {
+		Log.Fatal(err)
+	}
 }
 
 var volLsCmd = &cobra.Command{
@@ -96,7 +177,7 @@ func volLs(cmd *cobra.Command, args []string) {
 	LoadDB(args)
 	defer DB.Close()
 	// Query
-	rows, err := DB.Query("SELECT `uuid`, `name`, `desc` FROM `volumes`;")
+	rows, err := DB.Query("SELECT `uuid`, `name`, `desc`, `encryption` FROM `volumes`;")
 	if err != nil {
 		Log.Fatal(err)
 	}
@@ -106,10 +187,14 @@ func volLs(cmd *cobra.Command, args []string) {
 		var uuid string
 		var name string
 		var desc string
-		err := rows.Scan(&uuid, &name, &desc)
+		var encryption string
+		err := rows.Scan(&uuid, &name, &desc, &encryption)
 		if err != nil {
 			Log.Fatal(err)
 		}
+		if encryption != "" {
+			desc += " (encrypted: " + encryption + ")"
+		}
 		fmt.Println(uuid, aurora.Bold(name), desc)
 	}
 	if flag_empty {
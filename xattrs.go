@@ -0,0 +1,94 @@
+package main
+
+import (
+	"errors"
+	"sort"
+	"sync"
+)
+
+// Extended attributes also hold SELinux labels (security.selinux), POSIX ACLs (system.posix_acl_*) and file capabilities (security.capability)
+type XAttr struct {
+	Name  string `json:name`
+	Value []byte `json:value`
+}
+
+var ErrXAttrsNotSupported = errors.New("extended attributes are not supported")
+
+// Attributes the restore target could not take (so we warn only once about each one)
+var XAttrsWarned map[string]bool = make(map[string]bool)
+var XAttrsWarnedLock sync.Mutex
+
+// Reads the extended attributes of a file (without following links). Filesystems without support simply have none.
+func ReadXAttrs(path string) ([]XAttr, error) {
+	names, err := list_xattrs(path)
+	if err == ErrXAttrsNotSupported {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(names)
+	xattrs := make([]XAttr, 0, len(names))
+	for _, name := range names {
+		value, err := get_xattr(path, name)
+		if err == ErrXAttrsNotSupported {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		xattrs = append(xattrs, XAttr{Name: name, Value: value})
+	}
+	return xattrs, nil
+}
+
+func SaveXAttrs(q Querier, inode_uuid string, xattrs []XAttr) error {
+	for _, xattr := range xattrs {
+		_, err := q.Exec("INSERT OR REPLACE INTO `xattrs` (`inode_uuid`, `name`, `value`) VALUES (?, ?, ?);", inode_uuid, xattr.Name, xattr.Value)
+		if err != nil {
+			Log.Warning(err)
+			return err
+		}
+	}
+	return nil
+}
+
+func LoadXAttrs(inode_uuid string) ([]XAttr, error) {
+	rows, err := DB.Query("SELECT `name`, `value` FROM `xattrs` WHERE `inode_uuid` = ? ORDER BY `name` ASC;", inode_uuid)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	xattrs := make([]XAttr, 0)
+	for rows.Next() {
+		xattr := XAttr{}
+		err = rows.Scan(&xattr.Name, &xattr.Value)
+		if err != nil {
+			return nil, err
+		}
+		xattrs = append(xattrs, xattr)
+	}
+	return xattrs, rows.Err()
+}
+
+// Best effort: attributes the filesystem (or our privileges) can't take are skipped with a warning
+func restore_xattrs(node INode, dest string) {
+	xattrs, err := LoadXAttrs(node.UUID)
+	if err != nil {
+		Log.WarningF("Failed to load extended attributes of '%s': %s", node.OriginalPath, err)
+		return
+	}
+	for _, xattr := range xattrs {
+		err = set_xattr(dest, xattr.Name, xattr.Value)
+		if err == ErrXAttrsNotSupported {
+			XAttrsWarnedLock.Lock()
+			if !XAttrsWarned[xattr.Name] {
+				XAttrsWarned[xattr.Name] = true
+				Log.WarningF("Extended attribute '%s' can't be restored on '%s' (the filesystem does not support it), it will be skipped on other files too", xattr.Name, dest)
+			}
+			XAttrsWarnedLock.Unlock()
+		} else if err != nil {
+			Log.WarningF("Failed to set extended attribute '%s' of '%s': %s", xattr.Name, dest, err)
+		}
+	}
+}
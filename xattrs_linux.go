@@ -0,0 +1,67 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"bytes"
+
+	"golang.org/x/sys/unix"
+)
+
+func list_xattrs(path string) ([]string, error) {
+	for {
+		size, err := unix.Llistxattr(path, nil)
+		if err != nil {
+			return nil, xattr_error(err)
+		}
+		if size == 0 {
+			return nil, nil
+		}
+		buf := make([]byte, size)
+		size, err = unix.Llistxattr(path, buf)
+		if err == unix.ERANGE {
+			// It grew in the mean time
+			continue
+		}
+		if err != nil {
+			return nil, xattr_error(err)
+		}
+		names := make([]string, 0)
+		for _, name := range bytes.Split(buf[:size], []byte{0}) {
+			if len(name) > 0 {
+				names = append(names, string(name))
+			}
+		}
+		return names, nil
+	}
+}
+
+func get_xattr(path, name string) ([]byte, error) {
+	for {
+		size, err := unix.Lgetxattr(path, name, nil)
+		if err != nil {
+			return nil, xattr_error(err)
+		}
+		buf := make([]byte, size)
+		size, err = unix.Lgetxattr(path, name, buf)
+		if err == unix.ERANGE {
+			continue
+		}
+		if err != nil {
+			return nil, xattr_error(err)
+		}
+		return buf[:size], nil
+	}
+}
+
+func set_xattr(path, name string, value []byte) error {
+	return xattr_error(unix.Lsetxattr(path, name, value, 0))
+}
+
+func xattr_error(err error) error {
+	if err == unix.ENOTSUP || err == unix.EOPNOTSUPP {
+		return ErrXAttrsNotSupported
+	}
+	return err
+}
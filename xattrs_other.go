@@ -0,0 +1,16 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+func list_xattrs(path string) ([]string, error) {
+	return nil, ErrXAttrsNotSupported
+}
+
+func get_xattr(path, name string) ([]byte, error) {
+	return nil, ErrXAttrsNotSupported
+}
+
+func set_xattr(path, name string, value []byte) error {
+	return ErrXAttrsNotSupported
+}